@@ -0,0 +1,100 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package main // import "github.com/solnx/twister/cmd/twister"
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"github.com/mjolnir42/erebos"
+	"github.com/solnx/twister/internal/config"
+)
+
+// redacted replaces the value of secrets in the configuration dump
+const redacted = `<redacted>`
+
+// dumpConfig returns conf and settings as JSON with all secrets
+// redacted, indented if indent is set
+func dumpConfig(conf *erebos.Config, settings *config.Config,
+	indent bool) ([]byte, error) {
+	v := map[string]interface{}{
+		`erebos`:  redactValue(reflect.ValueOf(*conf)),
+		`twister`: redactValue(reflect.ValueOf(*settings)),
+	}
+	if indent {
+		return json.MarshalIndent(v, ``, `  `)
+	}
+	return json.Marshal(v)
+}
+
+// redactValue returns v as a value that can be marshalled to JSON.
+// Structs are returned as maps without their unexported fields. Fields
+// named like a secret are redacted, as are passwords in URLs. Pointers,
+// channels and functions are runtime state and are skipped.
+func redactValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Struct:
+		m := make(map[string]interface{}, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.PkgPath != `` {
+				continue
+			}
+			if isSecret(field.Name) {
+				m[field.Name] = redacted
+				continue
+			}
+			if value := redactValue(v.Field(i)); value != nil {
+				m[field.Name] = value
+			}
+		}
+		return m
+	case reflect.String:
+		return redactURL(v.String())
+	case reflect.Ptr, reflect.Interface, reflect.Chan, reflect.Func,
+		reflect.UnsafePointer:
+		return nil
+	default:
+		return v.Interface()
+	}
+}
+
+// isSecret reports if a configuration field of this name holds a
+// secret
+func isSecret(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{`password`, `passwd`, `secret`,
+		`token`} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURL returns s with the password of a URL redacted, other
+// strings are returned unchanged
+func redactURL(s string) string {
+	if !strings.Contains(s, `://`) {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); !ok {
+		return s
+	}
+	u.User = url.UserPassword(u.User.Username(), redacted)
+	return u.String()
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
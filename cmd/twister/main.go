@@ -11,10 +11,13 @@ package main // import "github.com/solnx/twister/cmd/twister"
 import (
 	"flag"
 	"fmt"
+	"io"
+	"math/rand"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
 
@@ -24,6 +27,7 @@ import (
 	"github.com/mjolnir42/erebos"
 	metrics "github.com/rcrowley/go-metrics"
 	"github.com/solnx/legacy"
+	"github.com/solnx/twister/internal/config"
 	"github.com/solnx/twister/internal/twister"
 )
 
@@ -38,15 +42,28 @@ func init() {
 }
 
 func main() {
+	// offline subcommands do not start the application
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case `split`:
+			os.Exit(splitCommand(os.Args[2:]))
+		case `replay`:
+			os.Exit(replayCommand(os.Args[2:]))
+		}
+	}
+
 	// parse command line flags
 	var (
 		cliConfPath string
 		versionFlag bool
+		dumpFlag    bool
 	)
 	flag.StringVar(&cliConfPath, `config`, `twister.conf`,
 		`Configuration file location`)
 	flag.BoolVar(&versionFlag, `version`, false,
 		`Print version information`)
+	flag.BoolVar(&dumpFlag, `dump-config`, false,
+		`Print the effective configuration and exit`)
 	flag.Parse()
 
 	// only provide version information if --version was specified
@@ -61,10 +78,26 @@ func main() {
 
 	// read runtime configuration
 	conf := erebos.Config{}
-	if err := conf.FromFile(cliConfPath); err != nil {
+	settings := config.Config{}
+	if err := settings.FromFile(cliConfPath, &conf); err != nil {
 		logrus.Fatalf("Could not open configuration: %s", err)
 	}
 
+	// erebos silently falls back to Newest for unknown consumer offset
+	// strategies, refuse to start on a misspelled value instead
+	switch strings.ToLower(strings.TrimSpace(
+		conf.Kafka.ConsumerOffsetStrategy,
+	)) {
+	case ``:
+	case `oldest`:
+		conf.Kafka.ConsumerOffsetStrategy = `Oldest`
+	case `newest`:
+		conf.Kafka.ConsumerOffsetStrategy = `Newest`
+	default:
+		logrus.Fatalf("Invalid consumer offset strategy: %s",
+			conf.Kafka.ConsumerOffsetStrategy)
+	}
+
 	// setup logfile
 	if lfh, err := reopen.NewFileWriter(
 		filepath.Join(conf.Log.Path, conf.Log.File),
@@ -74,8 +107,56 @@ func main() {
 		conf.Log.FH = lfh
 	}
 	logrus.SetOutput(conf.Log.FH)
+	if lvl, err := logLevel(&conf, &settings); err != nil {
+		logrus.Fatalf("Invalid log level: %s", err)
+	} else {
+		logrus.SetLevel(lvl)
+	}
 	logrus.Infoln(`Starting TWISTER...`)
 
+	// discover the Kafka brokers once for the topic pattern and all
+	// handlers
+	var brokers []string
+	if !settings.Twister.TestMode ||
+		settings.Kafka.ConsumerTopicPattern != `` {
+		var err error
+		if brokers, err = twister.DiscoverBrokers(&conf,
+			&settings); err != nil {
+			logrus.Fatalf("Could not discover Kafka brokers: %s", err)
+		}
+	}
+
+	// resolve the consumer topic pattern to the matching topics
+	if err := twister.ResolveConsumerTopics(&conf, &settings,
+		brokers); err != nil {
+		logrus.Fatalf("Could not resolve consumer topics: %s", err)
+	}
+	logrus.Infof("Consuming topics: %s", conf.Kafka.ConsumerTopics)
+
+	// erebos uses the commit interval unchecked
+	conf.Zookeeper.CommitInterval = commitInterval(&conf, &settings)
+
+	// a stray space in a pattern silently disables its enrichment
+	conf.Twister.QueryMetrics = twister.NormalizePatterns(
+		conf.Twister.QueryMetrics)
+	if !settings.Twister.DisableLookup {
+		logrus.Infof("Enriching metrics matching: %s",
+			strings.Join(conf.Twister.QueryMetrics, `, `))
+	}
+
+	// log the configuration after all defaults have been applied
+	if data, err := dumpConfig(&conf, &settings, dumpFlag); err != nil {
+		if dumpFlag {
+			logrus.Fatalf("Could not dump configuration: %s", err)
+		}
+		logrus.Warnf("Could not dump configuration: %s", err)
+	} else if dumpFlag {
+		fmt.Println(string(data))
+		os.Exit(0)
+	} else {
+		logrus.Infof("Effective configuration: %s", string(data))
+	}
+
 	// signal handler will reopen logfile on USR2 if requested
 	if conf.Log.Rotate {
 		sigChanLogRotate := make(chan os.Signal, 1)
@@ -111,6 +192,121 @@ func main() {
 		pfxRegistry)
 	metrics.NewRegisteredMeter(`/output/messages.per.second`,
 		pfxRegistry)
+	metrics.NewRegisteredMeter(`/input/heartbeats.per.second`,
+		pfxRegistry)
+	metrics.NewRegisteredMeter(`/output/deadletter.per.second`,
+		pfxRegistry)
+	metrics.NewRegisteredTimer(`/input/split.duration.ns`,
+		pfxRegistry)
+	metrics.NewRegisteredTimer(`/commit/latency`,
+		pfxRegistry)
+	metrics.NewRegisteredCounter(`/input/duplicates`,
+		pfxRegistry)
+	metrics.NewRegisteredGauge(`/output/inflight`,
+		pfxRegistry)
+	metrics.NewRegisteredCounter(`/input/enrichment.truncated`,
+		pfxRegistry)
+	metrics.NewRegisteredCounter(`/input/empty.batches`,
+		pfxRegistry)
+	metrics.NewRegisteredCounter(`/input/panics`,
+		pfxRegistry)
+	metrics.NewRegisteredCounter(`/input/poison.skipped`,
+		pfxRegistry)
+	metrics.NewRegisteredMeter(`/output/shadow.per.second`,
+		pfxRegistry)
+	metrics.NewRegisteredCounter(`/output/shadow.errors`,
+		pfxRegistry)
+	metrics.NewRegisteredCounter(`/input/oversized`,
+		pfxRegistry)
+	metrics.NewRegisteredCounter(`/enrichment/eligible`,
+		pfxRegistry)
+	metrics.NewRegisteredCounter(`/enrichment/tagged`,
+		pfxRegistry)
+	metrics.NewRegisteredCounter(`/enrichment/unconfigured`,
+		pfxRegistry)
+	metrics.NewRegisteredCounter(`/enrichment/error`,
+		pfxRegistry)
+	metrics.NewRegisteredHistogram(`/input/split.fanout`,
+		pfxRegistry, metrics.NewExpDecaySample(1028, 0.015))
+
+	// export Go runtime statistics, capturing them stops the world
+	// briefly
+	if settings.Twister.RuntimeMetrics {
+		rtRegistry := metrics.NewPrefixedChildRegistry(pfxRegistry, `/`)
+		metrics.RegisterRuntimeMemStats(rtRegistry)
+		go metrics.CaptureRuntimeMemStats(rtRegistry, 10*time.Second)
+	}
+
+	// skip messages that repeatedly stopped a handler, the handlers
+	// share the failure counts
+	var poison *twister.PoisonTracker
+	if tracker, err := twister.NewPoisonTracker(
+		settings.Twister.PoisonThreshold,
+		settings.Twister.PoisonStateFile,
+	); err != nil {
+		logrus.Fatalf("Could not set up poison detection: %s", err)
+	} else {
+		poison = tracker
+	}
+
+	// dump a snapshot of all metrics to stderr on USR1, USR2 is
+	// used for log rotation
+	sigChanDump := make(chan os.Signal, 1)
+	signal.Notify(sigChanDump, syscall.SIGUSR1)
+	go dumpMetrics(sigChanDump, pfxRegistry, os.Stderr)
+
+	// pause consumption on RTMIN and resume it on RTMIN+1, the
+	// consumer stays in its group while paused
+	paused := metrics.NewRegisteredGauge(`/input/paused`, pfxRegistry)
+	if pauseSignal != nil {
+		sigChanPause := make(chan os.Signal, 1)
+		signal.Notify(sigChanPause, pauseSignal, resumeSignal)
+		go pauseConsumption(sigChanPause, paused)
+	}
+
+	// meter the consumed messages and bytes per partition
+	if settings.Twister.PartitionMetrics {
+		twister.SetPartitionMetrics(&pfxRegistry)
+	}
+
+	// restrict this instance to a subset of hosts
+	if err := twister.SetHostFilter(settings.Twister.HostFilter,
+		&pfxRegistry); err != nil {
+		logrus.Fatalf("Could not set host filter: %s", err)
+	} else if len(settings.Twister.HostFilter) > 0 {
+		logrus.Infof("Processing only hosts %s",
+			strings.Join(settings.Twister.HostFilter, `, `))
+	}
+
+	// reject oversized messages before decoding them
+	twister.SetMaxMessageBytes(settings.Twister.MaxMessageBytes,
+		&pfxRegistry)
+
+	// setup optional per-host rate limit
+	if settings.Twister.HostRateLimit > 0 {
+		twister.SetHostRateLimit(settings.Twister.HostRateLimit,
+			settings.Twister.HostRateBurst, &pfxRegistry)
+		logrus.Infof("Limiting hosts to %d messages per second",
+			settings.Twister.HostRateLimit)
+	}
+
+	// select how hosts are assigned to handlers
+	if err := twister.SetDispatchStrategy(
+		&settings,
+		runtime.NumCPU(),
+	); err != nil {
+		logrus.Fatalf("Could not set dispatch strategy: %s", err)
+	}
+
+	// log clock skew corrections, they are easily forgotten
+	if settings.Twister.TimeOffset != 0 {
+		logrus.Warnf("Correcting all timestamps by %d seconds",
+			settings.Twister.TimeOffset)
+	}
+	for assetID, offset := range settings.Twister.TimeOffsetMap {
+		logrus.Warnf("Correcting timestamps of asset %s by %d seconds",
+			assetID, offset)
+	}
 
 	ms := legacy.NewMetricSocket(&conf, &pfxRegistry, handlerDeath,
 		twister.FormatMetrics)
@@ -124,18 +320,29 @@ func main() {
 		}()
 	}
 
-	// start application handlers
-	for i := 0; i < runtime.NumCPU(); i++ {
-		h := twister.Twister{
+	// register all application handlers before starting any of them,
+	// handlers check the registry during their setup
+	handlers := make([]*twister.Twister, runtime.NumCPU())
+	for i := range handlers {
+		handlers[i] = &twister.Twister{
 			Num: i,
 			Input: make(chan *erebos.Transport,
 				conf.Twister.HandlerQueueLength),
 			Shutdown: make(chan struct{}),
+			Ready:    make(chan struct{}),
 			Death:    handlerDeath,
 			Config:   &conf,
+			Settings: &settings,
 			Metrics:  &pfxRegistry,
+			Brokers:  brokers,
+			Poison:   poison,
 		}
-		twister.Handlers[i] = &h
+		twister.Handlers[i] = handlers[i]
+	}
+
+	// start application handlers
+	for i := range handlers {
+		h := handlers[i]
 		waitdelay.Use()
 		go func() {
 			defer waitdelay.Done()
@@ -144,25 +351,54 @@ func main() {
 		logrus.Infof("Launched Twister handler #%d", i)
 	}
 
-	// start kafka consumer
-	waitdelay.Use()
-	go func() {
-		defer waitdelay.Done()
-		erebos.Consumer(
-			&conf,
-			twister.Dispatch,
-			consumerShutdown,
-			consumerExit,
-			handlerDeath,
-		)
-	}()
+	// wait until all handlers finished their setup, a handler that
+	// fails to start aborts startup before anything is consumed
+	fault := false
+	for i := range handlers {
+		select {
+		case <-handlers[i].Ready:
+		case err := <-handlerDeath:
+			logrus.Errorf("Handler died: %s", err.Error())
+			fault = true
+		}
+		if fault {
+			break
+		}
+	}
 
-	heartbeat := time.Tick(10 * time.Second)
+	if fault {
+		// the consumer was never started
+		close(consumerExit)
+	} else {
+		// start kafka consumer
+		waitdelay.Use()
+		go func() {
+			defer waitdelay.Done()
+			// stagger the consumer group joins of restarted instances
+			if jitter := startupJitter(&settings); jitter > 0 {
+				logrus.Infof("Delaying consumer start by %s", jitter)
+				select {
+				case <-time.After(jitter):
+				case <-consumerShutdown:
+					close(consumerExit)
+					return
+				}
+			}
+			erebos.Consumer(
+				&conf,
+				twister.Dispatch,
+				consumerShutdown,
+				consumerExit,
+				handlerDeath,
+			)
+		}()
+	}
+
+	heartbeat := heartbeats(&settings)
 
 	// the main loop
-	fault := false
 runloop:
-	for {
+	for !fault {
 		select {
 		case err := <-ms.Errors:
 			logrus.Errorf("Socket error: %s", err.Error())
@@ -174,19 +410,14 @@ runloop:
 			fault = true
 			break runloop
 		case <-heartbeat:
-			for i := range twister.Handlers {
-				// do not block on heartbeats
-				waitdelay.Use()
-				go func(i int) {
-					twister.Handlers[i].InputChannel() <- erebos.NewHeartbeat()
-					waitdelay.Done()
-				}(i)
-			}
+			sendHeartbeats(waitdelay)
 		}
 	}
 
-	// close all handlers
+	// close all handlers, a consumer blocked by paused handlers can
+	// not shut down
 	close(ms.Shutdown)
+	twister.DisablePause()
 	close(consumerShutdown)
 
 	// not safe to close InputChannel before consumer is gone
@@ -218,4 +449,157 @@ drainloop:
 	}
 }
 
+// sendHeartbeats hands a heartbeat to every handler without blocking
+// the main loop. Paused handlers do not read their input, so no
+// heartbeats are sent while consumption is paused, instead of piling
+// up blocked senders.
+func sendHeartbeats(waitdelay *delay.Delay) {
+	if twister.Paused() {
+		return
+	}
+	for i := range twister.Handlers {
+		waitdelay.Use()
+		go func(i int) {
+			twister.Handlers[i].InputChannel() <- erebos.NewHeartbeat()
+			waitdelay.Done()
+		}(i)
+	}
+}
+
+// heartbeats returns a channel that delivers a tick every configured
+// heartbeat interval
+func heartbeats(settings *config.Config) <-chan time.Time {
+	return time.Tick(heartbeatInterval(settings))
+}
+
+// heartbeatInterval returns the configured interval between
+// heartbeats, which defaults to 10 seconds and may not be shorter
+// than one second
+func heartbeatInterval(settings *config.Config) time.Duration {
+	switch {
+	case settings.Misc.HeartbeatInterval == 0:
+		return 10 * time.Second
+	case settings.Misc.HeartbeatInterval < 1:
+		logrus.Warnf("Heartbeat interval %ds too short, using 1s",
+			settings.Misc.HeartbeatInterval)
+		return time.Second
+	default:
+		return time.Duration(settings.Misc.HeartbeatInterval) *
+			time.Second
+	}
+}
+
+// startupJitter returns a random delay of up to the configured
+// maximum before the consumer joins its group
+func startupJitter(settings *config.Config) time.Duration {
+	if settings.Misc.StartupJitterMaxMS <= 0 {
+		return 0
+	}
+	// every instance needs a different delay
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return time.Duration(rng.Int63n(
+		int64(settings.Misc.StartupJitterMaxMS),
+	)) * time.Millisecond
+}
+
+// defaultProcessingTimeout is the offset processing timeout that
+// erebos.Consumer sets for the consumer group
+const defaultProcessingTimeout = 10 * time.Second
+
+// processingTimeout returns the configured offset processing timeout
+// of the consumer group
+func processingTimeout(settings *config.Config) time.Duration {
+	if settings.Kafka.ProcessingTimeout > 0 {
+		return time.Duration(settings.Kafka.ProcessingTimeout) *
+			time.Millisecond
+	}
+	return defaultProcessingTimeout
+}
+
+// commitInterval returns the configured interval in milliseconds
+// between offset commits. The commit interval of the kafka section
+// replaces the one of the zookeeper section. Without an interval,
+// offsets would never be committed, so it defaults to 2 seconds. It
+// may not be shorter than 100 milliseconds, or longer than the
+// configured offset processing timeout.
+func commitInterval(conf *erebos.Config, settings *config.Config) int {
+	interval := conf.Zookeeper.CommitInterval
+	if settings.Kafka.CommitInterval != 0 {
+		interval = settings.Kafka.CommitInterval
+	}
+	max := int(processingTimeout(settings) / time.Millisecond)
+
+	switch {
+	case interval == 0:
+		logrus.Warnln(`No commit interval configured, using 2000ms`)
+		return 2000
+	case interval < 100:
+		logrus.Warnf("Commit interval %dms too short, using 100ms",
+			interval)
+		return 100
+	case interval > max:
+		logrus.Warnf("Commit interval %dms exceeds the offset"+
+			" processing timeout, using %dms", interval, max)
+		return max
+	default:
+		return interval
+	}
+}
+
+// dumpMetrics writes a snapshot of all metrics in registry to w for
+// every signal received on sig
+func dumpMetrics(sig chan os.Signal, registry metrics.Registry,
+	w io.Writer) {
+	for range sig {
+		logrus.Infoln(`Dumping metrics`)
+		twister.DumpMetrics(w, registry)
+	}
+}
+
+// pauseConsumption pauses consumption on pauseSignal and resumes it
+// on resumeSignal received on sig. The paused gauge is 1 while
+// consumption is paused.
+func pauseConsumption(sig chan os.Signal, paused metrics.Gauge) {
+	for s := range sig {
+		switch s {
+		case pauseSignal:
+			if twister.Pause() {
+				paused.Update(1)
+				logrus.Infoln(`Paused consumption`)
+			}
+		case resumeSignal:
+			if twister.Resume() {
+				paused.Update(0)
+				logrus.Infoln(`Resumed consumption`)
+			}
+		}
+	}
+}
+
+// logLevel returns the configured log level. An explicitly configured
+// level takes precedence over the legacy debug switch.
+func logLevel(conf *erebos.Config, settings *config.Config) (logrus.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(settings.Log.Level)) {
+	case ``:
+		if conf.Log.Debug {
+			return logrus.DebugLevel, nil
+		}
+		return logrus.InfoLevel, nil
+	case `trace`:
+		// logrus has no level below debug
+		return logrus.DebugLevel, nil
+	case `debug`:
+		return logrus.DebugLevel, nil
+	case `info`:
+		return logrus.InfoLevel, nil
+	case `warn`, `warning`:
+		return logrus.WarnLevel, nil
+	case `error`:
+		return logrus.ErrorLevel, nil
+	default:
+		return logrus.InfoLevel, fmt.Errorf("Unknown log level: %s",
+			settings.Log.Level)
+	}
+}
+
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,195 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package main // import "github.com/solnx/twister/cmd/twister"
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mjolnir42/delay"
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/twister/internal/config"
+	"github.com/solnx/twister/internal/twister"
+)
+
+func TestCommitInterval(t *testing.T) {
+	tests := []struct {
+		zookeeper int
+		kafka     int
+		timeout   int
+		expected  int
+	}{
+		{zookeeper: 0, kafka: 0, expected: 2000},
+		{zookeeper: 5000, kafka: 0, expected: 5000},
+		{zookeeper: 5000, kafka: 1000, expected: 1000},
+		{zookeeper: 0, kafka: 50, expected: 100},
+		{zookeeper: 30000, kafka: 0, expected: 10000},
+		{zookeeper: 1000, kafka: 20000, expected: 10000},
+		{zookeeper: 0, kafka: 20000, timeout: 30000, expected: 20000},
+		{zookeeper: 0, kafka: 5000, timeout: 3000, expected: 3000},
+	}
+
+	for _, test := range tests {
+		conf := erebos.Config{}
+		conf.Zookeeper.CommitInterval = test.zookeeper
+		settings := config.Config{}
+		settings.Kafka.CommitInterval = test.kafka
+		settings.Kafka.ProcessingTimeout = test.timeout
+
+		if got := commitInterval(&conf, &settings); got != test.expected {
+			t.Errorf("commitInterval(%d, %d, %d) = %d, expected %d",
+				test.zookeeper, test.kafka, test.timeout, got,
+				test.expected)
+		}
+	}
+}
+
+func TestProcessingTimeout(t *testing.T) {
+	for configured, expected := range map[int]time.Duration{
+		0:     10 * time.Second,
+		-1:    10 * time.Second,
+		30000: 30 * time.Second,
+	} {
+		settings := config.Config{}
+		settings.Kafka.ProcessingTimeout = configured
+		if got := processingTimeout(&settings); got != expected {
+			t.Errorf("processingTimeout(%d) = %s, expected %s",
+				configured, got, expected)
+		}
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	tests := []struct {
+		level    string
+		debug    bool
+		expected logrus.Level
+	}{
+		{level: ``, debug: false, expected: logrus.InfoLevel},
+		{level: ``, debug: true, expected: logrus.DebugLevel},
+		{level: `trace`, debug: false, expected: logrus.DebugLevel},
+		{level: `debug`, debug: false, expected: logrus.DebugLevel},
+		{level: `info`, debug: false, expected: logrus.InfoLevel},
+		{level: `warn`, debug: false, expected: logrus.WarnLevel},
+		{level: `warning`, debug: false, expected: logrus.WarnLevel},
+		{level: ` Error `, debug: false, expected: logrus.ErrorLevel},
+		// the configured level takes precedence over Debug
+		{level: `info`, debug: true, expected: logrus.InfoLevel},
+		{level: `warn`, debug: true, expected: logrus.WarnLevel},
+	}
+
+	for _, test := range tests {
+		conf := erebos.Config{}
+		conf.Log.Debug = test.debug
+		settings := config.Config{}
+		settings.Log.Level = test.level
+
+		got, err := logLevel(&conf, &settings)
+		if err != nil {
+			t.Errorf("logLevel(%q, %t): %s", test.level, test.debug, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("logLevel(%q, %t) = %s, expected %s", test.level,
+				test.debug, got, test.expected)
+		}
+	}
+
+	settings := config.Config{}
+	settings.Log.Level = `verbose`
+	if _, err := logLevel(&erebos.Config{}, &settings); err == nil {
+		t.Error(`logLevel accepted the unknown level verbose`)
+	}
+}
+
+func TestHeartbeatInterval(t *testing.T) {
+	for configured, expected := range map[int]time.Duration{
+		0:  10 * time.Second,
+		-5: time.Second,
+		1:  time.Second,
+		30: 30 * time.Second,
+	} {
+		settings := config.Config{}
+		settings.Misc.HeartbeatInterval = configured
+		if got := heartbeatInterval(&settings); got != expected {
+			t.Errorf("heartbeatInterval(%d) = %s, expected %s",
+				configured, got, expected)
+		}
+	}
+
+	settings := config.Config{}
+	settings.Misc.HeartbeatInterval = 1
+	start := time.Now()
+	select {
+	case <-heartbeats(&settings):
+		if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+			t.Errorf("Heartbeat after %s, expected 1s", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error(`No heartbeat within 5s, expected 1s`)
+	}
+}
+
+func TestSendHeartbeats(t *testing.T) {
+	defer func(handlers map[int]erebos.Handler) {
+		twister.Handlers = handlers
+	}(twister.Handlers)
+	input := make(chan *erebos.Transport, 2)
+	twister.Handlers = map[int]erebos.Handler{
+		0: &twister.Twister{Input: input},
+	}
+	waitdelay := delay.New()
+
+	// paused handlers receive no heartbeats
+	twister.Pause()
+	sendHeartbeats(waitdelay)
+	sendHeartbeats(waitdelay)
+	waitdelay.Wait()
+	if n := len(input); n != 0 {
+		t.Errorf("Sent %d heartbeats while paused", n)
+	}
+
+	twister.Resume()
+	sendHeartbeats(waitdelay)
+	waitdelay.Wait()
+	if n := len(input); n != 1 {
+		t.Errorf("Sent %d heartbeats, expected 1", n)
+	}
+}
+
+func TestDumpMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter(`/input/panics`, registry).Inc(3)
+	metrics.GetOrRegisterGauge(`/output/inflight.batches`,
+		registry).Update(2)
+
+	buf := &bytes.Buffer{}
+	sig := make(chan os.Signal, 1)
+	sig <- syscall.SIGUSR1
+	close(sig)
+	dumpMetrics(sig, registry, buf)
+
+	for _, line := range []string{
+		"/input/panics: 3\n",
+		"/output/inflight.batches: 2\n",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("Snapshot %q does not contain %q", buf.String(),
+				line)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
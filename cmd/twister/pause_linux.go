@@ -0,0 +1,24 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package main // import "github.com/solnx/twister/cmd/twister"
+
+import (
+	"os"
+	"syscall"
+)
+
+// pauseSignal and resumeSignal are the real-time signals RTMIN and
+// RTMIN+1 of the C library, which reserves the first two real-time
+// signals for itself
+var (
+	pauseSignal  os.Signal = syscall.Signal(34)
+	resumeSignal os.Signal = syscall.Signal(35)
+)
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
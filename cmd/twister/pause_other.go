@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package main // import "github.com/solnx/twister/cmd/twister"
+
+import "os"
+
+// pauseSignal and resumeSignal are nil on platforms without real-time
+// signals that Go can receive, consumption can not be paused there
+var (
+	pauseSignal  os.Signal
+	resumeSignal os.Signal
+)
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
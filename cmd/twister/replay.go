@@ -0,0 +1,60 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package main // import "github.com/solnx/twister/cmd/twister"
+
+import (
+	"flag"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mjolnir42/erebos"
+	"github.com/solnx/twister/internal/config"
+	"github.com/solnx/twister/internal/twister"
+)
+
+// replayCommand implements the replay subcommand, which processes a
+// range of messages from a source topic like the handlers do, and
+// writes or produces the metrics without touching the offsets of the
+// live consumer group. It returns the exit code.
+func replayCommand(args []string) int {
+	var (
+		cliConfPath string
+		opts        twister.ReplayOptions
+	)
+	fs := flag.NewFlagSet(`replay`, flag.ContinueOnError)
+	fs.StringVar(&cliConfPath, `config`, `twister.conf`,
+		`Configuration file location`)
+	opts.Flags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	// log to STDERR, STDOUT may carry the replayed metrics
+	logrus.SetOutput(os.Stderr)
+
+	if opts.Topic == `` {
+		logrus.Errorln(`No topic to replay specified`)
+		return 2
+	}
+
+	conf := erebos.Config{}
+	settings := config.Config{}
+	if err := settings.FromFile(cliConfPath, &conf); err != nil {
+		logrus.Errorf("Could not open configuration: %s", err)
+		return 1
+	}
+
+	if err := twister.Replay(&conf, &settings, opts, os.Stdout); err != nil {
+		logrus.Errorf("Replay failed: %s", err)
+		return 1
+	}
+	return 0
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
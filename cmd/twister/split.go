@@ -0,0 +1,79 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package main // import "github.com/solnx/twister/cmd/twister"
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/solnx/twister/internal/split"
+)
+
+// splitCommand implements the split subcommand, which splits a file
+// of MetricBatch JSON into newline delimited MetricSplit JSON without
+// connecting to Kafka, Zookeeper or Redis. It returns the exit code.
+func splitCommand(args []string) int {
+	var inPath, outPath string
+	fs := flag.NewFlagSet(`split`, flag.ContinueOnError)
+	fs.StringVar(&inPath, `in`, `-`,
+		`MetricBatch input file, one batch per line (- for STDIN)`)
+	fs.StringVar(&outPath, `out`, `-`,
+		`MetricSplit output file (- for STDOUT)`)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var in io.Reader = os.Stdin
+	if inPath != `-` {
+		fh, err := os.Open(inPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer fh.Close()
+		in = fh
+	}
+
+	var out io.Writer = os.Stdout
+	var outFile *os.File
+	if outPath != `-` {
+		fh, err := os.Create(outPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		outFile = fh
+		out = fh
+	}
+
+	skipped, err := split.Stream(in, out, os.Stderr)
+	if err != nil {
+		if outFile != nil {
+			outFile.Close()
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// write errors on the output file can surface only on close
+	if outFile != nil {
+		if err = outFile.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "Skipped %d invalid batches\n", skipped)
+		return 2
+	}
+	return 0
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
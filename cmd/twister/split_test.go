@@ -0,0 +1,55 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package main // import "github.com/solnx/twister/cmd/twister"
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitCommandOutputFile(t *testing.T) {
+	testdata := filepath.Join(`..`, `..`, `internal`, `split`, `testdata`)
+	dir, err := ioutil.TempDir(``, `twister-split`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// batches.json contains one invalid batch
+	outPath := filepath.Join(dir, `splits.json`)
+	if code := splitCommand([]string{
+		`-in`, filepath.Join(testdata, `batches.json`),
+		`-out`, outPath,
+	}); code != 2 {
+		t.Errorf("Exit code %d, expected 2", code)
+	}
+	out, err := ioutil.ReadFile(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ioutil.ReadFile(filepath.Join(testdata, `splits.golden`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, expected) {
+		t.Errorf("Output file differs from splits.golden:\n%s", out)
+	}
+
+	if code := splitCommand([]string{
+		`-in`, filepath.Join(testdata, `batches.json`),
+		`-out`, filepath.Join(dir, `missing`, `splits.json`),
+	}); code != 1 {
+		t.Errorf("Exit code %d for unwritable output, expected 1", code)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,156 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+// Package config holds the twister settings that are not part of
+// erebos.Config. They are read from the same configuration file as
+// the erebos settings.
+package config // import "github.com/solnx/twister/internal/config"
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mjolnir42/erebos"
+	ucl "github.com/nahanni/go-ucl"
+)
+
+// Config holds the twister settings, grouped into the same sections
+// as erebos.Config
+type Config struct {
+	Log struct {
+		Level string `json:"level"`
+	} `json:"log"`
+	Zookeeper struct {
+		DiscoveryAttempts   int `json:"discovery.attempts,string"`
+		DiscoveryIntervalMS int `json:"discovery.interval.ms,string"`
+	} `json:"zookeeper"`
+	Kafka struct {
+		CommitInterval          int    `json:"commit.interval.ms,string"`
+		ProcessingTimeout       int    `json:"processing.timeout.ms,string"`
+		ConsumerTopicPattern    string `json:"consumer.topic.pattern"`
+		ProducerRetryBackoffMS  int    `json:"producer.retry.backoff.ms,string"`
+		ProducerMaxMessageBytes int    `json:"producer.max.message.bytes,string"`
+		DeadLetterTopic         string `json:"producer.dead.letter.topic"`
+	} `json:"kafka"`
+	Misc struct {
+		HeartbeatInterval  int `json:"heartbeat.interval.seconds,string"`
+		StartupJitterMaxMS int `json:"startup.jitter.max.ms,string"`
+	} `json:"misc"`
+	Twister struct {
+		TestMode              bool                         `json:"test.mode,string"`
+		TestModeCommit        bool                         `json:"test.mode.commit,string"`
+		Dedupe                string                       `json:"dedupe"`
+		EmitTombstones        bool                         `json:"emit.tombstones,string"`
+		TombstoneTTL          int                          `json:"tombstone.ttl.seconds,string"`
+		TombstoneMaxHosts     int                          `json:"tombstone.max.hosts,string"`
+		MaxInFlight           int                          `json:"max.in.flight,string"`
+		ShutdownTimeout       int                          `json:"shutdown.timeout.seconds,string"`
+		TimeOffset            int                          `json:"time.offset.seconds,string"`
+		TimeOffsetMap         map[string]Number            `json:"time.offset.map"`
+		DispatchStrategy      string                       `json:"dispatch.strategy"`
+		PartitionMetrics      bool                         `json:"partition.metrics,string"`
+		RuntimeMetrics        bool                         `json:"runtime.metrics,string"`
+		RebatchSize           int                          `json:"output.rebatch.size,string"`
+		TrackingID            string                       `json:"tracking.id"`
+		ShadowTopic           string                       `json:"shadow.topic"`
+		ShadowFormat          string                       `json:"shadow.format"`
+		PoisonThreshold       int                          `json:"poison.threshold,string"`
+		PoisonStateFile       string                       `json:"poison.state.file"`
+		DisableRecover        bool                         `json:"panic.recover.disable,string"`
+		ProduceRetries        int                          `json:"produce.retries,string"`
+		ProduceRetryBackoffMS int                          `json:"produce.retry.backoff.ms,string"`
+		HandlerWorkers        int                          `json:"handler.workers,string"`
+		DebugSampleRate       int                          `json:"debug.sample.rate,string"`
+		TopicShards           int                          `json:"output.topic.shards,string"`
+		HostFilter            []string                     `json:"host.filter"`
+		HostRateLimit         int                          `json:"host.rate.limit,string"`
+		HostRateBurst         int                          `json:"host.rate.burst,string"`
+		TenantLabel           string                       `json:"tenant.label"`
+		TenantTopicMap        map[string]string            `json:"tenant.topic.map"`
+		PrefixTopicMap        map[string]string            `json:"prefix.topic.map"`
+		SourceTopicMap        map[string]string            `json:"source.topic.map"`
+		RouteTopics           []string                     `json:"route.topics"`
+		TypeTopicMap          map[string]string            `json:"type.topic.map"`
+		EnumMap               map[string]map[string]Number `json:"enum.map"`
+		MaxMessageBytes       int                          `json:"max.message.bytes,string"`
+		AssetIDField          string                       `json:"asset.id.field"`
+		ProtocolLabel         bool                         `json:"protocol.label,string"`
+		SourceLabels          bool                         `json:"source.labels,string"`
+		MetricUnits           map[string]string            `json:"metric.units"`
+		DisableLookup         bool                         `json:"lookup.disable,string"`
+		EnrichmentMaxTags     int                          `json:"enrichment.max.tags,string"`
+		EnrichmentTagPrefix   string                       `json:"enrichment.tag.prefix"`
+	} `json:"twister"`
+}
+
+// Number is an integer inside a configuration map. The configuration
+// parser reports scalar values as strings, so Number accepts quoted
+// and unquoted integers.
+type Number int
+
+// UnmarshalJSON implements json.Unmarshaler
+func (n *Number) UnmarshalJSON(data []byte) error {
+	v, err := strconv.Atoi(strings.Trim(string(data), `"`))
+	if err != nil {
+		return err
+	}
+	*n = Number(v)
+	return nil
+}
+
+// FromFile reads the configuration file fname into both conf and c
+func (c *Config) FromFile(fname string, conf *erebos.Config) error {
+	var (
+		file, uclJSON []byte
+		err           error
+		uclData       map[string]interface{}
+	)
+	if fname, err = filepath.Abs(fname); err != nil {
+		return err
+	}
+	if fname, err = filepath.EvalSymlinks(fname); err != nil {
+		return err
+	}
+	if file, err = ioutil.ReadFile(fname); err != nil {
+		return err
+	}
+
+	parser := ucl.NewParser(bytes.NewBuffer(file))
+	if uclData, err = parser.Ucl(); err != nil {
+		return err
+	}
+	normalize(uclData)
+
+	if uclJSON, err = json.Marshal(uclData); err != nil {
+		return err
+	}
+	if err = json.Unmarshal(uclJSON, conf); err != nil {
+		return err
+	}
+	return json.Unmarshal(uclJSON, c)
+}
+
+// normalize rewrites options of uclData that accept more than one
+// form to the form expected by erebos.Config. The enriched metric
+// paths may be given as a single comma separated string instead of an
+// array.
+func normalize(uclData map[string]interface{}) {
+	section, ok := uclData[`twister`].(map[string]interface{})
+	if !ok {
+		return
+	}
+	if paths, ok := section[`query.metric.profiles`].(string); ok {
+		section[`query.metric.profiles`] = []interface{}{paths}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
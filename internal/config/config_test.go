@@ -0,0 +1,43 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package config // import "github.com/solnx/twister/internal/config"
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeQueryMetrics(t *testing.T) {
+	for _, tc := range []struct {
+		value    interface{}
+		expected interface{}
+	}{
+		{`/sys/load/60s, /sys/cpu/`,
+			[]interface{}{`/sys/load/60s, /sys/cpu/`}},
+		{[]interface{}{`/sys/load/60s`, `/sys/cpu/`},
+			[]interface{}{`/sys/load/60s`, `/sys/cpu/`}},
+	} {
+		uclData := map[string]interface{}{
+			`twister`: map[string]interface{}{
+				`query.metric.profiles`: tc.value,
+			},
+		}
+		normalize(uclData)
+		got := uclData[`twister`].(map[string]interface{})[`query.metric.profiles`]
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Normalized %v to %v, expected %v", tc.value, got,
+				tc.expected)
+		}
+	}
+
+	// configurations without a twister section are left alone
+	normalize(map[string]interface{}{`kafka`: `twister`})
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,82 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+// Package split converts MetricBatch JSON into MetricSplit JSON
+// without any Kafka involvement
+package split // import "github.com/solnx/twister/internal/split"
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/solnx/legacy"
+)
+
+// maxLineSize is the largest MetricBatch that Stream accepts
+const maxLineSize = 64 * 1024 * 1024
+
+// Batch decodes a MetricBatch and returns its split metrics,
+// marshalled the same way the twister handlers produce them
+func Batch(data []byte) ([][]byte, error) {
+	batch := legacy.MetricBatch{}
+	if err := json.Unmarshal(data, &batch); err != nil {
+		return nil, err
+	}
+
+	msgs := batch.Split()
+	res := make([][]byte, 0, len(msgs))
+	for i := range msgs {
+		b, err := json.Marshal(&msgs[i])
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, b)
+	}
+	return res, nil
+}
+
+// Stream reads one MetricBatch per line from r and writes the split
+// metrics to w as newline delimited JSON. Lines that fail to split are
+// reported to errw and skipped. It returns the number of skipped
+// lines.
+func Stream(r io.Reader, w, errw io.Writer) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	out := bufio.NewWriter(w)
+
+	var line, skipped int
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		msgs, err := Batch(scanner.Bytes())
+		if err != nil {
+			fmt.Fprintf(errw, "line %d: %s\n", line, err.Error())
+			skipped++
+			continue
+		}
+		for i := range msgs {
+			if _, err = out.Write(msgs[i]); err != nil {
+				return skipped, err
+			}
+			if err = out.WriteByte('\n'); err != nil {
+				return skipped, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return skipped, err
+	}
+	return skipped, out.Flush()
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,54 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package split // import "github.com/solnx/twister/internal/split"
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool(`update`, false, `update the golden files`)
+
+func TestStreamGolden(t *testing.T) {
+	in, err := os.Open(filepath.Join(`testdata`, `batches.json`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	out := &bytes.Buffer{}
+	errw := &bytes.Buffer{}
+	skipped, err := Stream(in, out, errw)
+	if err != nil {
+		t.Fatalf("Stream: %s", err)
+	}
+	if skipped != 1 || !bytes.HasPrefix(errw.Bytes(), []byte(`line 3: `)) {
+		t.Errorf("Skipped %d lines, expected line 3: %s", skipped, errw)
+	}
+
+	golden := filepath.Join(`testdata`, `splits.golden`)
+	if *update {
+		if err = ioutil.WriteFile(golden, out.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), expected) {
+		t.Errorf("Split output differs from %s:\n%s", golden, out)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
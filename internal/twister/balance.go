@@ -0,0 +1,134 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/mjolnir42/erebos"
+	"github.com/solnx/twister/internal/config"
+)
+
+const (
+	// DispatchModulo assigns every host to the handler hostID modulo
+	// the number of handlers
+	DispatchModulo = `modulo`
+	// DispatchBalanced assigns idle hosts to the handler with the
+	// fewest pending messages
+	DispatchBalanced = `balanced`
+)
+
+// balance is the host assignment used by Dispatch for the balanced
+// strategy, it is nil for the modulo strategy
+var balance *balancer
+
+// SetDispatchStrategy selects how Dispatch assigns hosts to handlers.
+// With the balanced strategy, a host keeps its handler while it has
+// messages pending in it, so that the ordering per host is preserved.
+// Once idle, the host is reassigned to the handler with the fewest
+// pending messages, which moves busy hosts away from each other. The
+// balanced strategy is refused if the handlers keep per-host state,
+// which would be lost when a host moves.
+func SetDispatchStrategy(settings *config.Config, handlers int) error {
+	switch settings.Twister.DispatchStrategy {
+	case ``, DispatchModulo:
+		balance = nil
+	case DispatchBalanced:
+		if settings.Twister.EmitTombstones {
+			return fmt.Errorf("Dispatch strategy %s is incompatible"+
+				" with emitting tombstones", DispatchBalanced)
+		}
+		if settings.Twister.Dedupe != `` {
+			return fmt.Errorf("Dispatch strategy %s is incompatible"+
+				" with dedupe mode %s", DispatchBalanced,
+				settings.Twister.Dedupe)
+		}
+		balance = &balancer{
+			pending: make([]int, handlers),
+			hosts:   make(map[int]*assignment),
+		}
+	default:
+		return fmt.Errorf("Unknown dispatch strategy: %s",
+			settings.Twister.DispatchStrategy)
+	}
+	return nil
+}
+
+// balancer tracks the handler assignment and pending messages of all
+// hosts
+type balancer struct {
+	sync.Mutex
+	pending []int
+	hosts   map[int]*assignment
+}
+
+// assignment is the handler of a host and the number of its messages
+// that the handler has not yet processed
+type assignment struct {
+	handler int
+	pending int
+}
+
+// assign returns the handler for the next message of hostID and
+// counts the message as pending
+func (b *balancer) assign(hostID int) int {
+	b.Lock()
+	defer b.Unlock()
+
+	// idle hosts are not tracked and are free to move
+	a, ok := b.hosts[hostID]
+	if !ok {
+		a = &assignment{handler: b.idlest(hostID % len(b.pending))}
+		b.hosts[hostID] = a
+	}
+	a.pending++
+	b.pending[a.handler]++
+	return a.handler
+}
+
+// done marks a message of hostID as processed by its handler
+func (b *balancer) done(hostID int) {
+	b.Lock()
+	defer b.Unlock()
+
+	a, ok := b.hosts[hostID]
+	if !ok {
+		return
+	}
+	a.pending--
+	b.pending[a.handler]--
+	// forget idle hosts, their next message may go to another handler
+	if a.pending == 0 {
+		delete(b.hosts, hostID)
+	}
+}
+
+// release releases msg from the balanced dispatch once the handler
+// processed it
+func release(msg *erebos.Transport) {
+	if balance == nil || erebos.IsHeartbeat(msg) {
+		return
+	}
+	balance.done(msg.HostID)
+}
+
+// idlest returns the handler with the fewest pending messages,
+// preferring current on a tie
+func (b *balancer) idlest(current int) int {
+	min := current
+	for i := range b.pending {
+		if b.pending[i] < b.pending[min] {
+			min = i
+		}
+	}
+	return min
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,105 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"testing"
+
+	"github.com/solnx/twister/internal/config"
+)
+
+// simulateDispatch assigns the messages of a skewed host distribution
+// to four handlers that each process one message per round. Hosts 0
+// and 4 send a message every round and share a handler under modulo,
+// hosts 1 and 2 send every fourth round. It returns the largest
+// backlog of a handler and fails t if a host had messages pending in
+// two handlers at once.
+func simulateDispatch(t *testing.T, assign func(int) int) int {
+	handlers := make([][]int, 4)
+	pending := map[int]int{}
+	owner := map[int]int{}
+	max := 0
+
+	for round := 0; round < 1000; round++ {
+		hosts := []int{0, 4}
+		if round%4 == 0 {
+			hosts = append(hosts, 1, 2)
+		}
+		for _, hostID := range hosts {
+			h := assign(hostID)
+			if pending[hostID] > 0 && owner[hostID] != h {
+				t.Fatalf("Host %d assigned to handler %d while pending"+
+					" in handler %d", hostID, h, owner[hostID])
+			}
+			owner[hostID] = h
+			pending[hostID]++
+			handlers[h] = append(handlers[h], hostID)
+		}
+		for h := range handlers {
+			if len(handlers[h]) > max {
+				max = len(handlers[h])
+			}
+			if len(handlers[h]) == 0 {
+				continue
+			}
+			hostID := handlers[h][0]
+			handlers[h] = handlers[h][1:]
+			pending[hostID]--
+			if balance != nil {
+				balance.done(hostID)
+			}
+		}
+	}
+	return max
+}
+
+func TestDispatchBalancedSkewedHosts(t *testing.T) {
+	defer SetDispatchStrategy(newTestSettings(), 4)
+
+	settings := newTestSettings()
+	if err := SetDispatchStrategy(settings, 4); err != nil {
+		t.Fatal(err)
+	}
+	modulo := simulateDispatch(t, func(hostID int) int {
+		return hostID % 4
+	})
+
+	settings.Twister.DispatchStrategy = DispatchBalanced
+	if err := SetDispatchStrategy(settings, 4); err != nil {
+		t.Fatal(err)
+	}
+	balanced := simulateDispatch(t, balance.assign)
+
+	if balanced >= modulo {
+		t.Errorf("Balanced backlog %d, modulo backlog %d", balanced,
+			modulo)
+	}
+	if balanced > 2 {
+		t.Errorf("Balanced backlog %d, expected at most 2", balanced)
+	}
+}
+
+func TestDispatchBalancedRefusesHostState(t *testing.T) {
+	defer SetDispatchStrategy(newTestSettings(), 4)
+
+	tombstones := newTestSettings()
+	tombstones.Twister.DispatchStrategy = DispatchBalanced
+	tombstones.Twister.EmitTombstones = true
+	dedupe := newTestSettings()
+	dedupe.Twister.DispatchStrategy = DispatchBalanced
+	dedupe.Twister.Dedupe = dedupeLast
+
+	for _, settings := range []*config.Config{tombstones, dedupe} {
+		if err := SetDispatchStrategy(settings, 4); err == nil {
+			t.Error(`Balanced dispatch accepted per-host state`)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,91 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"sync"
+
+	"github.com/mjolnir42/erebos"
+)
+
+// committer commits the offsets of processed messages in the order
+// they were pushed, from a single goroutine per handler. Like queue,
+// it is unbounded so that the handler's event loop never blocks on
+// the consumer accepting a commit.
+type committer struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	items  []pendingCommit
+	closed bool
+	poison *PoisonTracker
+}
+
+// pendingCommit is a message waiting for its offset to be committed,
+// and the outcome to report on its Return channel afterwards
+type pendingCommit struct {
+	msg *erebos.Transport
+	err error
+}
+
+// newCommitter returns an empty committer that clears the failures of
+// committed messages in poison, if any
+func newCommitter(poison *PoisonTracker) *committer {
+	c := &committer{poison: poison}
+	c.cond = sync.NewCond(&c.mutex)
+	return c
+}
+
+// push schedules the offset of msg to be committed and err to be
+// reported afterwards
+func (c *committer) push(msg *erebos.Transport, err error) {
+	c.mutex.Lock()
+	c.items = append(c.items, pendingCommit{msg: msg, err: err})
+	c.mutex.Unlock()
+	c.cond.Signal()
+}
+
+// close marks the committer as closed, offsets already pushed are
+// still committed
+func (c *committer) close() {
+	c.mutex.Lock()
+	c.closed = true
+	c.mutex.Unlock()
+	c.cond.Broadcast()
+}
+
+// run commits pushed offsets until the committer is closed and empty
+func (c *committer) run() {
+	for {
+		c.mutex.Lock()
+		for len(c.items) == 0 && !c.closed {
+			c.cond.Wait()
+		}
+		if len(c.items) == 0 {
+			c.mutex.Unlock()
+			return
+		}
+		batch := c.items
+		c.items = nil
+		c.mutex.Unlock()
+
+		for _, p := range batch {
+			p.msg.Commit <- &erebos.Commit{
+				Topic:     p.msg.Topic,
+				Partition: p.msg.Partition,
+				Offset:    p.msg.Offset,
+			}
+			reply(p.msg, p.err)
+			if c.poison != nil {
+				c.poison.clear(p.msg)
+			}
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
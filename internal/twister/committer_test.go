@@ -0,0 +1,122 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/mjolnir42/erebos"
+)
+
+func TestCommitterCommitsAllOffsets(t *testing.T) {
+	c := newCommitter(nil)
+	commits := make(chan *erebos.Commit)
+	msgs := make([]*erebos.Transport, 1000)
+	for i := range msgs {
+		msgs[i] = &erebos.Transport{
+			Topic:  `metrics`,
+			Offset: int64(i),
+			Commit: commits,
+			Return: make(chan error, 1),
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.run()
+		close(done)
+	}()
+	for _, msg := range msgs {
+		c.push(msg, nil)
+	}
+	c.close()
+
+	// offsets are committed in the order they were pushed
+	for i := range msgs {
+		commit := <-commits
+		if commit.Offset != int64(i) {
+			t.Fatalf("Committed offset %d, expected %d", commit.Offset, i)
+		}
+	}
+	<-done
+	for i, msg := range msgs {
+		select {
+		case err := <-msg.Return:
+			if err != nil {
+				t.Errorf("Offset %d reported %s", i, err)
+			}
+		default:
+			t.Errorf("Offset %d reported no result", i)
+		}
+	}
+}
+
+// BenchmarkCommit compares committing through the committer against
+// committing from a goroutine per message
+func BenchmarkCommit(b *testing.B) {
+	msg := func(commits chan *erebos.Commit, offset int) *erebos.Transport {
+		return &erebos.Transport{
+			Topic:  `metrics`,
+			Offset: int64(offset),
+			Commit: commits,
+		}
+	}
+	consume := func(commits chan *erebos.Commit, n int) chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < n; i++ {
+				<-commits
+			}
+			close(done)
+		}()
+		return done
+	}
+
+	b.Run(`committer`, func(b *testing.B) {
+		commits := make(chan *erebos.Commit)
+		done := consume(commits, b.N)
+		c := newCommitter(nil)
+		go c.run()
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			c.push(msg(commits, i), nil)
+		}
+		<-done
+		b.StopTimer()
+		c.close()
+	})
+
+	b.Run(`goroutines`, func(b *testing.B) {
+		commits := make(chan *erebos.Commit)
+		done := consume(commits, b.N)
+		wg := sync.WaitGroup{}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			wg.Add(1)
+			go func(m *erebos.Transport) {
+				defer wg.Done()
+				m.Commit <- &erebos.Commit{
+					Topic:     m.Topic,
+					Partition: m.Partition,
+					Offset:    m.Offset,
+				}
+			}(msg(commits, i))
+		}
+		<-done
+		b.StopTimer()
+		wg.Wait()
+	})
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,49 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+// completedSize is the number of recently completed trackingIDs that
+// are remembered per handler
+const completedSize = 4096
+
+// completed remembers the most recently completed trackingIDs, so that
+// late producer successes for them can be told apart from unknown
+// trackingIDs. The oldest trackingID is forgotten once the set is
+// full.
+type completed struct {
+	ids  map[string]struct{}
+	ring []string
+	next int
+}
+
+// newCompleted returns an empty set
+func newCompleted() *completed {
+	return &completed{
+		ids:  make(map[string]struct{}, completedSize),
+		ring: make([]string, completedSize),
+	}
+}
+
+// add remembers trackingID as completed
+func (c *completed) add(trackingID string) {
+	if old := c.ring[c.next]; old != `` {
+		delete(c.ids, old)
+	}
+	c.ring[c.next] = trackingID
+	c.ids[trackingID] = struct{}{}
+	c.next = (c.next + 1) % len(c.ring)
+}
+
+// has reports if trackingID was recently completed
+func (c *completed) has(trackingID string) bool {
+	_, ok := c.ids[trackingID]
+	return ok
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
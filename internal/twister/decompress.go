@@ -0,0 +1,110 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/solnx/legacy"
+)
+
+// gzipMagic are the first bytes of every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decompress returns the decompressed value if value is gzip
+// compressed, and value unchanged otherwise. If max is positive, at
+// most max bytes are decompressed and errOversized is returned for
+// larger values.
+func decompress(value []byte, max int) ([]byte, error) {
+	if !bytes.HasPrefix(value, gzipMagic) {
+		return value, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	if max <= 0 {
+		return ioutil.ReadAll(zr)
+	}
+
+	// read one byte more than allowed to detect oversized values
+	// without decompressing all of them
+	data, err := ioutil.ReadAll(io.LimitReader(zr, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > max {
+		return nil, errOversized
+	}
+	return data, nil
+}
+
+// peekHostID returns the HostID of the batch in value. A gzip
+// compressed batch is only decompressed until its host_id field was
+// read, which usually is the first field. If max is positive, at most
+// max bytes are decompressed and errOversized is returned if the
+// host_id field was not found within them.
+func peekHostID(value []byte, max int) (int, error) {
+	if !bytes.HasPrefix(value, gzipMagic) {
+		return legacy.PeekHostID(value)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(value))
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+	r := io.Reader(zr)
+	limit := &io.LimitedReader{R: zr, N: int64(max) + 1}
+	if max > 0 {
+		r = limit
+	}
+
+	hostID, err := scanHostID(json.NewDecoder(r))
+	if err != nil && max > 0 && limit.N == 0 {
+		return 0, errOversized
+	}
+	return hostID, err
+}
+
+// scanHostID reads the top level object of a batch from dec until its
+// host_id field, and returns its value. A batch without host_id has
+// the HostID 0.
+func scanHostID(dec *json.Decoder) (int, error) {
+	if tok, err := dec.Token(); err != nil {
+		return 0, err
+	} else if tok != json.Delim('{') {
+		return 0, fmt.Errorf("Batch is not a JSON object")
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return 0, err
+		}
+		if key == `host_id` {
+			hostID := 0
+			err = dec.Decode(&hostID)
+			return hostID, err
+		}
+		skipped := json.RawMessage{}
+		if err = dec.Decode(&skipped); err != nil {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,99 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// gzipped returns data gzip compressed
+func gzipped(t testing.TB, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDispatchGzipIdenticalSplits(t *testing.T) {
+	p := newFakeProducer(nil)
+	h := startHandler(t, newTestSettings(), p)
+
+	batch := testBatch(4, `/sys/load/60s`, `/sys/load/300s`)
+	for _, value := range [][]byte{batch, gzipped(t, batch)} {
+		if err := Dispatch(*h.message(value)); err != nil {
+			t.Fatalf("Dispatch: %s", err)
+		}
+		h.waitCommits(t, 1)
+	}
+	h.stop(t)
+
+	produced := p.messages()
+	if len(produced) != 4 {
+		t.Fatalf("Produced %d messages, expected 4", len(produced))
+	}
+	// the workers may hand the metrics of a batch over in any order
+	values := make([]string, 0, len(produced))
+	for _, msg := range produced {
+		value, _ := msg.Value.Encode()
+		values = append(values, string(value))
+	}
+	plain, compressed := values[:2], values[2:]
+	sort.Strings(plain)
+	sort.Strings(compressed)
+	if !reflect.DeepEqual(plain, compressed) {
+		t.Errorf("Split %v from the gzipped batch, expected %v",
+			compressed, plain)
+	}
+}
+
+func TestDecompressInvalidGzip(t *testing.T) {
+	value := gzipped(t, testBatch(4, `/sys/load/60s`))
+	if _, err := decompress(value[:len(value)/2], 0); err == nil {
+		t.Error(`decompress accepted a truncated gzip stream`)
+	}
+}
+
+func TestPeekHostID(t *testing.T) {
+	batch := testBatch(4, `/sys/load/60s`, `/sys/load/300s`)
+	for _, value := range [][]byte{batch, gzipped(t, batch)} {
+		if hostID, err := peekHostID(value, 0); err != nil || hostID != 4 {
+			t.Errorf("peekHostID = %d, %v, expected 4", hostID, err)
+		}
+	}
+
+	// only the start of a gzipped batch is decompressed, the stream is
+	// cut off after the host_id field
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	zw.Write(batch[:len(`{"host_id":4,`)])
+	zw.Flush()
+	start := buf.Len()
+	zw.Write(batch[len(`{"host_id":4,`):])
+	zw.Close()
+	if hostID, err := peekHostID(buf.Bytes()[:start], 0); err != nil ||
+		hostID != 4 {
+		t.Errorf("peekHostID of the stream start = %d, %v, expected 4",
+			hostID, err)
+	}
+
+	if _, err := peekHostID(gzipped(t, []byte(`[4]`)), 0); err == nil {
+		t.Error(`peekHostID accepted a batch that is no JSON object`)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
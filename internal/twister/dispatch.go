@@ -8,25 +8,91 @@
 
 package twister // import "github.com/solnx/twister/internal/twister"
 
-import (
-	"runtime"
+import "github.com/mjolnir42/erebos"
 
-	"github.com/mjolnir42/erebos"
-	"github.com/solnx/legacy"
-)
-
-// Dispatch implements erebos.Dispatcher
+// Dispatch implements erebos.Dispatcher. All pending messages of a
+// host are routed to the same handler, so a host's batches are split
+// in the order they were consumed. All metrics of an asset are handed
+// to the producer by the same handler worker, in the order they were
+// split. The producer keys every metric by its AssetID, which hashes
+// all metrics of an asset to the same partition of a topic. Only
+// metrics produced again after a failure may be reordered.
+//
+// With the balanced dispatch strategy, a host whose batches were all
+// split may move to another handler while metrics of its earlier
+// batches are still queued in the previous handler. The metrics of
+// its batches before and after the move may then be produced out of
+// order.
+//
+// Dispatch fails while no handlers are registered.
 func Dispatch(msg erebos.Transport) error {
+	// there is no handler to route the message to, or to commit it
+	if len(Handlers) == 0 {
+		return errNoHandlers
+	}
+
+	if partitions != nil {
+		partitions.mark(msg.Topic, msg.Partition, len(msg.Value))
+	}
+
+	max := 0
+	if sizer != nil {
+		max = sizer.max
+	}
+	if err := decode(&msg, max); err == errOversized {
+		sizer.reject(&msg)
+		drop(&msg, errOversized)
+		return nil
+	} else if err != nil {
+		return err
+	}
 	// send all messages from the same host to the same
 	// handler to keep the ordering intact
-	hostID, err := legacy.PeekHostID(msg.Value)
+	hostID := msg.HostID
+
+	// skip messages of hosts this instance does not process
+	if filter != nil && !filter.allow(hostID) {
+		drop(&msg, errFiltered)
+		return nil
+	}
+
+	// drop messages from hosts that exceed their rate limit
+	if limiter != nil && !limiter.allow(hostID) {
+		drop(&msg, errRateLimited)
+		return nil
+	}
+
+	if balance != nil {
+		Handlers[balance.assign(hostID)].InputChannel() <- &msg
+		return nil
+	}
+	Handlers[hostID%len(Handlers)].InputChannel() <- &msg
+	return nil
+}
+
+// decode sets the HostID of the consumed msg. If max is positive,
+// messages larger than max bytes are rejected with errOversized
+// before they are decoded. Compressed batches are decompressed by
+// their handler, on the consumer only as far as needed to read the
+// HostID.
+func decode(msg *erebos.Transport, max int) error {
+	if max > 0 && len(msg.Value) > max {
+		return errOversized
+	}
+	hostID, err := peekHostID(msg.Value, max)
 	if err != nil {
 		return err
 	}
 	msg.HostID = hostID
-
-	Handlers[hostID%runtime.NumCPU()].InputChannel() <- &msg
 	return nil
 }
 
+// drop discards msg without processing it. Its offset is still
+// committed so the partition makes progress, and err is replied. The
+// commit is handed to the committer of the host's handler, which the
+// handler waits for during shutdown.
+func drop(msg *erebos.Transport, err error) {
+	Handlers[msg.HostID%len(Handlers)].(*Twister).commit(msg, err)
+}
+
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
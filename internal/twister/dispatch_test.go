@@ -0,0 +1,189 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+func TestDispatchRateLimitPerHost(t *testing.T) {
+	p := newFakeProducer(nil)
+	h := startHandler(t, newTestSettings(), p)
+	SetHostRateLimit(1, 2, h.Metrics)
+	defer SetHostRateLimit(0, 0, h.Metrics)
+
+	// host 1 exceeds its burst of two messages, host 2 does not
+	var throttled, untouched []*erebos.Transport
+	for i := 0; i < 5; i++ {
+		msg := h.message(testBatch(1, `/sys/load/60s`))
+		throttled = append(throttled, msg)
+		if err := Dispatch(*msg); err != nil {
+			t.Fatalf("Dispatch: %s", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		msg := h.message(testBatch(2, `/sys/load/60s`))
+		untouched = append(untouched, msg)
+		if err := Dispatch(*msg); err != nil {
+			t.Fatalf("Dispatch: %s", err)
+		}
+	}
+
+	// dropped messages are committed as well
+	committed := map[int64]bool{}
+	for _, offset := range h.waitCommits(t, 7) {
+		committed[offset] = true
+	}
+	if len(committed) != 7 {
+		t.Errorf("Committed offsets %v, expected 0 to 6", committed)
+	}
+
+	for i, msg := range throttled {
+		err := result(t, msg)
+		switch {
+		case i < 2 && err != nil:
+			t.Errorf("Message %d of host 1 failed: %s", i, err)
+		case i >= 2 && err != errRateLimited:
+			t.Errorf("Message %d of host 1 reported %v, expected %s",
+				i, err, errRateLimited)
+		}
+	}
+	for i, msg := range untouched {
+		if err := result(t, msg); err != nil {
+			t.Errorf("Message %d of host 2 failed: %s", i, err)
+		}
+	}
+
+	hosts := map[string]int{}
+	for _, msg := range p.messages() {
+		key, _ := msg.Key.Encode()
+		hosts[string(key)]++
+	}
+	if hosts[`1`] != 2 || hosts[`2`] != 2 {
+		t.Errorf("Produced %v messages per host, expected 2 each", hosts)
+	}
+	dropped := metrics.GetOrRegisterMeter(`/input/ratelimited.per.second`,
+		*h.Metrics)
+	if n := dropped.Count(); n != 3 {
+		t.Errorf("Counted %d rate limited messages, expected 3", n)
+	}
+
+	h.stop(t)
+}
+
+func TestDispatchRejectsOversized(t *testing.T) {
+	h := startHandler(t, newTestSettings(), newFakeProducer(nil))
+	SetMaxMessageBytes(256, h.Metrics)
+	defer SetMaxMessageBytes(0, nil)
+
+	// the large payload is not a batch, decoding it would fail. The
+	// gzipped payloads are small, but not once decompressed. Dispatch
+	// rejects the batch whose host_id follows the oversized data, the
+	// handler the batch whose host_id comes first.
+	padding := bytes.Repeat([]byte(`x`), 1<<16)
+	large := h.message(bytes.Repeat([]byte(`x`), 257))
+	bomb := h.message(gzipped(t, []byte(fmt.Sprintf(
+		`{"host_id":1,"data":%q}`, padding))))
+	hidden := h.message(gzipped(t, []byte(fmt.Sprintf(
+		`{"data":%q,"host_id":1}`, padding))))
+	valid := h.message(testBatch(1, `/sys/load/60s`))
+	for _, msg := range []*erebos.Transport{large, bomb, hidden, valid} {
+		if err := Dispatch(*msg); err != nil {
+			t.Fatalf("Dispatch decoded offset %d: %s", msg.Offset, err)
+		}
+	}
+	h.waitCommits(t, 4)
+	h.stop(t)
+
+	for _, msg := range []*erebos.Transport{large, bomb, hidden} {
+		if err := result(t, msg); err != errOversized {
+			t.Errorf("Offset %d reported %v, expected %s", msg.Offset,
+				err, errOversized)
+		}
+	}
+	if err := result(t, valid); err != nil {
+		t.Errorf("Valid message reported %s", err)
+	}
+	counter := metrics.GetOrRegisterCounter(`/input/oversized`,
+		*h.Metrics)
+	if n := counter.Count(); n != 3 {
+		t.Errorf("Counted %d oversized messages, expected 3", n)
+	}
+}
+
+func TestDispatchWithoutHandlers(t *testing.T) {
+	defer func(handlers map[int]erebos.Handler) {
+		Handlers = handlers
+	}(Handlers)
+
+	Handlers = map[int]erebos.Handler{}
+	msg := erebos.Transport{Value: testBatch(1, `/sys/load/60s`)}
+	if err := Dispatch(msg); err != errNoHandlers {
+		t.Errorf("Dispatch returned %v, expected %s", err, errNoHandlers)
+	}
+}
+
+func TestDispatchOrderingPerAsset(t *testing.T) {
+	settings := newTestSettings()
+	settings.Twister.HandlerWorkers = 4
+	p := newFakeProducer(nil)
+	h := startHandler(t, settings, p)
+
+	// interleaved batches of three hosts, every batch one second later
+	for i := 0; i < 20; i++ {
+		for hostID := 1; hostID <= 3; hostID++ {
+			ts := testTime.Add(time.Duration(i) * time.Second)
+			if err := Dispatch(*h.message(testBatchAt(hostID, ts,
+				`/sys/load/60s`, `/sys/load/300s`))); err != nil {
+				t.Fatalf("Dispatch: %s", err)
+			}
+		}
+	}
+	h.waitCommits(t, 60)
+	h.stop(t)
+
+	// every asset is produced to a single partition, in the order its
+	// batches were consumed
+	partition := map[string]int32{}
+	last := map[string]string{}
+	for _, msg := range p.messages() {
+		key, _ := msg.Key.Encode()
+		asset := string(key)
+		if prev, ok := partition[asset]; ok && prev != msg.Partition {
+			t.Fatalf("Asset %s produced to partitions %d and %d", asset,
+				prev, msg.Partition)
+		}
+		partition[asset] = msg.Partition
+
+		data, _ := msg.Value.Encode()
+		split := []interface{}{}
+		if err := json.Unmarshal(data, &split); err != nil {
+			t.Fatal(err)
+		}
+		// RFC3339 timestamps of the same zone sort lexically
+		ts := split[2].(string)
+		if ts < last[asset] {
+			t.Fatalf("Asset %s produced %s after %s", asset, ts,
+				last[asset])
+		}
+		last[asset] = ts
+	}
+	if len(partition) != 3 {
+		t.Errorf("Produced %d assets, expected 3", len(partition))
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
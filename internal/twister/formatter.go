@@ -10,6 +10,7 @@ package twister // import "github.com/solnx/twister/internal/twister"
 
 import (
 	"fmt"
+	"io"
 	"os"
 
 	metrics "github.com/rcrowley/go-metrics"
@@ -32,6 +33,71 @@ func FormatMetrics(batch *legacy.PluginMetricBatch) func(string, interface{}) {
 					FlpVal: value.Rate1(),
 				},
 			})
+		case *metrics.StandardGauge:
+			value := v.(*metrics.StandardGauge)
+			batch.Metrics = append(batch.Metrics, legacy.PluginMetric{
+				Type:   `int`,
+				Metric: metric,
+				Value: legacy.MetricValue{
+					IntVal: value.Value(),
+				},
+			})
+		case *metrics.StandardGaugeFloat64:
+			value := v.(*metrics.StandardGaugeFloat64)
+			batch.Metrics = append(batch.Metrics, legacy.PluginMetric{
+				Type:   `float`,
+				Metric: metric,
+				Value: legacy.MetricValue{
+					FlpVal: value.Value(),
+				},
+			})
+		case *metrics.StandardCounter:
+			value := v.(*metrics.StandardCounter)
+			batch.Metrics = append(batch.Metrics, legacy.PluginMetric{
+				Type:   `int`,
+				Metric: metric,
+				Value: legacy.MetricValue{
+					IntVal: value.Count(),
+				},
+			})
+		case *metrics.StandardHistogram:
+			value := v.(*metrics.StandardHistogram).Snapshot()
+			ps := value.Percentiles([]float64{0.5, 0.99})
+			batch.Metrics = append(batch.Metrics, legacy.PluginMetric{
+				Type:   `float`,
+				Metric: fmt.Sprintf("%s/avg", metric),
+				Value: legacy.MetricValue{
+					FlpVal: value.Mean(),
+				},
+			}, legacy.PluginMetric{
+				Type:   `float`,
+				Metric: fmt.Sprintf("%s/percentile/50", metric),
+				Value: legacy.MetricValue{
+					FlpVal: ps[0],
+				},
+			}, legacy.PluginMetric{
+				Type:   `float`,
+				Metric: fmt.Sprintf("%s/percentile/99", metric),
+				Value: legacy.MetricValue{
+					FlpVal: ps[1],
+				},
+			})
+		case *metrics.StandardTimer:
+			value := v.(*metrics.StandardTimer).Snapshot()
+			ps := value.Percentiles([]float64{0.5, 0.99})
+			batch.Metrics = append(batch.Metrics, legacy.PluginMetric{
+				Type:   `float`,
+				Metric: fmt.Sprintf("%s/percentile/50", metric),
+				Value: legacy.MetricValue{
+					FlpVal: ps[0],
+				},
+			}, legacy.PluginMetric{
+				Type:   `float`,
+				Metric: fmt.Sprintf("%s/percentile/99", metric),
+				Value: legacy.MetricValue{
+					FlpVal: ps[1],
+				},
+			})
 		}
 	}
 }
@@ -39,12 +105,49 @@ func FormatMetrics(batch *legacy.PluginMetricBatch) func(string, interface{}) {
 // DebugFormatMetrics is the formatting function to print Twister
 // metrics on STDERR.
 func DebugFormatMetrics(_ *legacy.PluginMetricBatch) func(string, interface{}) {
+	return debugFormat(os.Stderr)
+}
+
+// DumpMetrics writes a snapshot of all metrics in registry to w, in
+// the format of DebugFormatMetrics
+func DumpMetrics(w io.Writer, registry metrics.Registry) {
+	registry.Each(debugFormat(w))
+}
+
+// debugFormat returns the formatting function that prints metrics to
+// w
+func debugFormat(w io.Writer) func(string, interface{}) {
 	return func(metric string, v interface{}) {
 		switch v.(type) {
 		case *metrics.StandardMeter:
 			value := v.(*metrics.StandardMeter)
-			fmt.Fprintf(os.Stderr, "%s/avg/rate/1min: %f\n",
+			fmt.Fprintf(w, "%s/avg/rate/1min: %f\n",
 				metric, value.Rate1())
+		case *metrics.StandardGauge:
+			value := v.(*metrics.StandardGauge)
+			fmt.Fprintf(w, "%s: %d\n", metric, value.Value())
+		case *metrics.StandardGaugeFloat64:
+			value := v.(*metrics.StandardGaugeFloat64)
+			fmt.Fprintf(w, "%s: %f\n", metric, value.Value())
+		case *metrics.StandardCounter:
+			value := v.(*metrics.StandardCounter)
+			fmt.Fprintf(w, "%s: %d\n", metric, value.Count())
+		case *metrics.StandardHistogram:
+			value := v.(*metrics.StandardHistogram).Snapshot()
+			ps := value.Percentiles([]float64{0.5, 0.99})
+			fmt.Fprintf(w, "%s/avg: %f\n",
+				metric, value.Mean())
+			fmt.Fprintf(w, "%s/percentile/50: %f\n",
+				metric, ps[0])
+			fmt.Fprintf(w, "%s/percentile/99: %f\n",
+				metric, ps[1])
+		case *metrics.StandardTimer:
+			value := v.(*metrics.StandardTimer).Snapshot()
+			ps := value.Percentiles([]float64{0.5, 0.99})
+			fmt.Fprintf(w, "%s/percentile/50: %f\n",
+				metric, ps[0])
+			fmt.Fprintf(w, "%s/percentile/99: %f\n",
+				metric, ps[1])
 		}
 	}
 }
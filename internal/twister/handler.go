@@ -10,113 +10,232 @@ package twister // import "github.com/solnx/twister/internal/twister"
 
 import (
 	"fmt"
-	"os"
 	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/Sirupsen/logrus"
 	"github.com/mjolnir42/delay"
 	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
 	wall "github.com/solnx/eye/lib/eye.wall"
-	kazoo "github.com/wvanbergen/kazoo-go"
+	libtwister "github.com/solnx/twister/lib/twister"
 )
 
+// lookupCloser is an Enricher that has to be closed when the handler
+// shuts down
+type lookupCloser interface {
+	Enricher
+	Close()
+}
+
+// startLookup starts the lookup of the handler's configuration IDs
+var startLookup = func(conf *erebos.Config) (lookupCloser, error) {
+	lookup := wall.NewLookup(conf, `twister`)
+	if err := lookup.Start(); err != nil {
+		return nil, err
+	}
+	return lookup, nil
+}
+
 // Implementation of the erebos.Handler interface
 
 // Start sets up the Twister application
 func (t *Twister) Start() {
 	if len(Handlers) == 0 {
-		t.Death <- fmt.Errorf(`Incorrectly set handlers`)
-		<-t.Shutdown
+		t.startFailed(fmt.Errorf(`Incorrectly set handlers`))
 		return
 	}
 
-	kz, err := kazoo.NewKazooFromConnectionString(
-		t.Config.Zookeeper.Connect, nil)
-	if err != nil {
-		t.Death <- err
-		<-t.Shutdown
-		return
-	}
-	brokers, err := kz.BrokerList()
-	if err != nil {
-		kz.Close()
-		t.Death <- err
-		<-t.Shutdown
+	switch t.Settings.Twister.Dedupe {
+	case ``, dedupeExact, dedupeLast:
+	default:
+		t.startFailed(fmt.Errorf("Unknown dedupe mode: %s",
+			t.Settings.Twister.Dedupe))
 		return
 	}
-	kz.Close()
 
-	host, err := os.Hostname()
-	if err != nil {
-		t.Death <- err
-		<-t.Shutdown
+	switch t.Settings.Twister.TrackingID {
+	case ``, trackCounter, trackUUID:
+	default:
+		t.startFailed(fmt.Errorf("Unknown trackingID scheme: %s",
+			t.Settings.Twister.TrackingID))
 		return
 	}
 
-	config := sarama.NewConfig()
-	// set transport keepalive
-	switch t.Config.Kafka.Keepalive {
-	case 0:
-		config.Net.KeepAlive = 3 * time.Second
-	default:
-		config.Net.KeepAlive = time.Duration(
-			t.Config.Kafka.Keepalive,
-		) * time.Millisecond
-	}
-	// set our required persistence confidence for producing
-	switch t.Config.Kafka.ProducerResponseStrategy {
-	case `NoResponse`:
-		config.Producer.RequiredAcks = sarama.NoResponse
-	case `WaitForLocal`:
-		config.Producer.RequiredAcks = sarama.WaitForLocal
-	case `WaitForAll`:
-		config.Producer.RequiredAcks = sarama.WaitForAll
+	switch t.Settings.Twister.ShadowFormat {
+	case ``, shadowArray, shadowObject:
 	default:
-		config.Producer.RequiredAcks = sarama.WaitForLocal
+		t.startFailed(fmt.Errorf("Unknown shadow format: %s",
+			t.Settings.Twister.ShadowFormat))
+		return
 	}
 
-	// set return parameters
-	config.Producer.Return.Errors = true
-	config.Producer.Return.Successes = true
-
-	// set how often to retry producing
-	switch t.Config.Kafka.ProducerRetry {
-	case 0:
-		config.Producer.Retry.Max = 3
-	default:
-		config.Producer.Retry.Max = t.Config.Kafka.ProducerRetry
+	// correct the timestamps of hosts with a known clock offset
+	if skew, err := newSkew(t.Settings); err == nil {
+		t.skew = skew
+	} else {
+		t.startFailed(err)
+		return
 	}
-	config.Producer.Partitioner = sarama.NewHashPartitioner
-	config.ClientID = fmt.Sprintf("twister.%s", host)
 
 	t.trackID = make(map[string]int)
 	t.trackACK = make(map[string][]*erebos.Transport)
+	t.trackTime = make(map[string]time.Time)
+	t.retries = make(map[*sarama.ProducerMessage]int)
+	t.done = newCompleted()
+
+	// start the lookup before the producer, so that only a producer
+	// assigned before Start has to be torn down on failure. Without
+	// the lookup, no metric is enriched and twister runs without
+	// Redis and Eye.
+	if !t.Settings.Twister.DisableLookup {
+		var err error
+		if t.lookPaths, err = libtwister.NewPathMatcher(
+			t.Config.Twister.QueryMetrics,
+		); err != nil {
+			t.startFailed(err)
+			return
+		}
+
+		// an Enricher assigned before Start is used as is
+		if t.lookup == nil {
+			var lookup lookupCloser
+			if lookup, err = startLookup(t.Config); err != nil {
+				t.startFailed(err)
+				return
+			}
+			defer lookup.Close()
+			t.lookup = lookup
+		}
+	} else {
+		t.lookup = nil
+	}
 
-	t.producer, err = sarama.NewAsyncProducer(brokers, config)
-	if err != nil {
-		t.Death <- err
-		<-t.Shutdown
-		return
+	// in test mode no producer is created and the workers only log
+	// the messages they would produce
+	if t.Settings.Twister.TestMode {
+		logrus.Warnf("Twister handler #%d running in test mode", t.Num)
+	} else {
+		if t.producer == nil {
+			var err error
+			if t.producer, err = t.newProducer(); err != nil {
+				t.startFailed(err)
+				return
+			}
+		}
+		t.dispatch = t.producer.Input()
 	}
-	t.dispatch = t.producer.Input()
 	t.delay = delay.New()
 
-	t.lookup = wall.NewLookup(t.Config, `twister`)
-	if err = t.lookup.Start(); err != nil {
-		t.Death <- err
-		<-t.Shutdown
-		return
+	// offsets are committed in order from a single goroutine
+	t.commits = newCommitter(t.Poison)
+	t.delay.Use()
+	go func() {
+		t.commits.run()
+		t.delay.Done()
+	}()
+
+	t.deadMeter = metrics.GetOrRegisterMeter(
+		`/output/deadletter.per.second`,
+		*t.Metrics,
+	)
+	t.splitTimer = metrics.GetOrRegisterTimer(
+		`/input/split.duration.ns`,
+		*t.Metrics,
+	)
+	t.fanout = metrics.GetOrRegisterHistogram(
+		`/input/split.fanout`,
+		*t.Metrics,
+		metrics.NewExpDecaySample(1028, 0.015),
+	)
+	t.inflight = metrics.GetOrRegisterGauge(
+		`/output/inflight`,
+		*t.Metrics,
+	)
+	t.commitTime = metrics.GetOrRegisterTimer(
+		`/commit/latency`,
+		*t.Metrics,
+	)
+	t.shadowOut = metrics.GetOrRegisterMeter(
+		`/output/shadow.per.second`,
+		*t.Metrics,
+	)
+	t.shadowErrs = metrics.GetOrRegisterCounter(
+		`/output/shadow.errors`,
+		*t.Metrics,
+	)
+	t.panics = metrics.GetOrRegisterCounter(
+		`/input/panics`,
+		*t.Metrics,
+	)
+	t.poisoned = metrics.GetOrRegisterCounter(
+		`/input/poison.skipped`,
+		*t.Metrics,
+	)
+	t.zeroSplits = metrics.GetOrRegisterCounter(
+		`/input/empty.batches`,
+		*t.Metrics,
+	)
+	t.tagCounter = metrics.GetOrRegisterCounter(
+		`/input/enrichment.truncated`,
+		*t.Metrics,
+	)
+	t.dupCounter = metrics.GetOrRegisterCounter(
+		`/input/duplicates`,
+		*t.Metrics,
+	)
+	t.eligible = metrics.GetOrRegisterCounter(
+		`/enrichment/eligible`,
+		*t.Metrics,
+	)
+	t.tagged = metrics.GetOrRegisterCounter(
+		`/enrichment/tagged`,
+		*t.Metrics,
+	)
+	t.unconfig = metrics.GetOrRegisterCounter(
+		`/enrichment/unconfigured`,
+		*t.Metrics,
+	)
+	t.lookupErrs = metrics.GetOrRegisterCounter(
+		`/enrichment/error`,
+		*t.Metrics,
+	)
+	t.maxBytes = maxMessageBytes(t.Settings)
+	if t.Settings.Twister.EmitTombstones {
+		t.tombs = newTombstones(t.Settings)
 	}
-	defer t.lookup.Close()
 
-	t.lookKeys = make(map[string]bool)
-	for _, path := range t.Config.Twister.QueryMetrics {
-		t.lookKeys[path] = true
+	// start the workers handing messages to the producer, each with
+	// a queue of its own
+	t.pool = delay.New()
+	t.halt = make(chan struct{})
+	t.skipped = make(chan string)
+	workers := t.Settings.Twister.HandlerWorkers
+	if workers <= 0 {
+		workers = 4
+	}
+	t.queues = make([]*queue, workers)
+	for i := range t.queues {
+		t.queues[i] = newQueue()
+		t.pool.Use()
+		go t.worker(t.queues[i])
 	}
 
+	// setup is complete
+	close(t.Ready)
 	t.run()
 }
 
+// startFailed reports err after Start failed. A producer assigned
+// before Start is closed, then startFailed waits for the shutdown.
+func (t *Twister) startFailed(err error) {
+	if t.producer != nil {
+		t.producer.Close()
+	}
+	t.Death <- err
+	<-t.Shutdown
+}
+
 // InputChannel returns the data input channel
 func (t *Twister) InputChannel() chan *erebos.Transport {
 	return t.Input
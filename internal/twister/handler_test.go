@@ -0,0 +1,132 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+func TestStartLookupFailureClosesProducer(t *testing.T) {
+	lookupErr := errors.New(`Redis unavailable`)
+	defer func(f func(*erebos.Config) (lookupCloser, error)) {
+		startLookup = f
+	}(startLookup)
+	startLookup = func(*erebos.Config) (lookupCloser, error) {
+		return nil, lookupErr
+	}
+
+	settings := newTestSettings()
+	settings.Twister.DisableLookup = false
+	p := newFakeProducer(nil)
+	h := newTestHandler(settings, p)
+	h.start()
+
+	select {
+	case err := <-h.Death:
+		if err != lookupErr {
+			t.Errorf("Handler died with %v, expected %s", err, lookupErr)
+		}
+	case <-h.Ready:
+		t.Fatal(`Handler started without lookup`)
+	case <-time.After(testTimeout):
+		t.Fatal(`Handler did not fail`)
+	}
+	if !p.isClosed() {
+		t.Error(`Producer was not closed after the lookup failed`)
+	}
+
+	close(h.Shutdown)
+	select {
+	case <-h.stopped:
+	case <-time.After(testTimeout):
+		t.Fatal(`Handler did not stop`)
+	}
+}
+
+func TestStartWithoutLookup(t *testing.T) {
+	defer func(f func(*erebos.Config) (lookupCloser, error)) {
+		startLookup = f
+	}(startLookup)
+	started := false
+	startLookup = func(*erebos.Config) (lookupCloser, error) {
+		started = true
+		return nil, errors.New(`Lookup started`)
+	}
+
+	p := newFakeProducer(nil)
+	h := newTestHandler(newTestSettings(), p)
+	h.Config.Twister.QueryMetrics = []string{`/sys/load/60s`}
+	h.start()
+	select {
+	case <-h.Ready:
+	case err := <-h.Death:
+		t.Fatalf("Handler failed to start: %s", err)
+	case <-time.After(testTimeout):
+		t.Fatal(`Handler did not start`)
+	}
+
+	h.send(testBatch(1, `/sys/load/60s`))
+	h.waitCommits(t, 1)
+	h.stop(t)
+
+	if started {
+		t.Error(`Lookup was started although it is disabled`)
+	}
+	if n := len(p.messages()); n != 1 {
+		t.Errorf("Produced %d messages, expected 1", n)
+	}
+}
+
+func TestTestModeProducesNothing(t *testing.T) {
+	for _, commit := range []bool{false, true} {
+		settings := newTestSettings()
+		settings.Twister.TestMode = true
+		settings.Twister.TestModeCommit = commit
+		p := newFakeProducer(nil)
+		h := startHandler(t, settings, p)
+
+		for i := 0; i < 10; i++ {
+			msg := h.send(testBatch(i, `/sys/load/60s`, `/sys/load/300s`))
+			if err := result(t, msg); err != nil {
+				t.Errorf("Message %d failed: %s", i, err)
+			}
+		}
+		h.stop(t)
+
+		if n := len(p.messages()); n != 0 {
+			t.Errorf("Produced %d messages in test mode", n)
+		}
+		committed := len(h.commits)
+		if commit && committed != 10 {
+			t.Errorf("Committed %d offsets, expected 10", committed)
+		}
+		if !commit && committed != 0 {
+			t.Errorf("Committed %d offsets without test.mode.commit",
+				committed)
+		}
+
+		in := metrics.GetOrRegisterMeter(`/input/messages.per.second`,
+			*h.Metrics)
+		if n := in.Count(); n != 10 {
+			t.Errorf("Counted %d input messages, expected 10", n)
+		}
+		fanout := metrics.GetOrRegisterHistogram(`/input/split.fanout`,
+			*h.Metrics, nil)
+		if n := fanout.Sum(); n != 20 {
+			t.Errorf("Counted %d split metrics, expected 20", n)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
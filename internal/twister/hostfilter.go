@@ -0,0 +1,98 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// filter is the host filter used by Dispatch, it is nil if all hosts
+// are processed
+var filter *hostFilter
+
+// SetHostFilter restricts Dispatch to the hosts in ranges. Every entry
+// is either a single hostID or an inclusive range of hostIDs written
+// as first-last. Messages of other hosts are committed without being
+// processed and counted. An empty list processes all hosts.
+func SetHostFilter(ranges []string, registry *metrics.Registry) error {
+	if len(ranges) == 0 {
+		filter = nil
+		return nil
+	}
+
+	f := &hostFilter{
+		filtered: metrics.GetOrRegisterMeter(
+			`/input/filtered.per.second`,
+			*registry,
+		),
+	}
+	for _, entry := range ranges {
+		r, err := parseHostRange(entry)
+		if err != nil {
+			return err
+		}
+		f.ranges = append(f.ranges, r)
+	}
+	filter = f
+	return nil
+}
+
+// hostFilter is a list of hostID ranges
+type hostFilter struct {
+	ranges   []hostRange
+	filtered metrics.Meter
+}
+
+// hostRange is an inclusive range of hostIDs
+type hostRange struct {
+	first int
+	last  int
+}
+
+// parseHostRange parses entry as hostID or first-last range
+func parseHostRange(entry string) (hostRange, error) {
+	parts := strings.SplitN(strings.TrimSpace(entry), `-`, 2)
+	first, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return hostRange{}, fmt.Errorf("Invalid host range %s: %s",
+			entry, err.Error())
+	}
+	last := first
+	if len(parts) == 2 {
+		if last, err = strconv.Atoi(
+			strings.TrimSpace(parts[1]),
+		); err != nil {
+			return hostRange{}, fmt.Errorf(
+				"Invalid host range %s: %s", entry, err.Error())
+		}
+	}
+	if last < first {
+		return hostRange{}, fmt.Errorf("Invalid host range %s:"+
+			" last host before first host", entry)
+	}
+	return hostRange{first: first, last: last}, nil
+}
+
+// allow reports if hostID is in any of the ranges of f, messages of
+// other hosts are counted
+func (f *hostFilter) allow(hostID int) bool {
+	for _, r := range f.ranges {
+		if hostID >= r.first && hostID <= r.last {
+			return true
+		}
+	}
+	f.filtered.Mark(1)
+	return false
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
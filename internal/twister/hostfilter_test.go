@@ -0,0 +1,76 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"testing"
+
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+func TestDispatchHostFilter(t *testing.T) {
+	p := newFakeProducer(nil)
+	h := startHandler(t, newTestSettings(), p)
+	if err := SetHostFilter([]string{`10-20`, `5`}, h.Metrics); err != nil {
+		t.Fatal(err)
+	}
+	defer SetHostFilter(nil, nil)
+
+	outside := h.message(testBatch(3, `/sys/load/60s`))
+	for _, msg := range []*erebos.Transport{
+		outside,
+		h.message(testBatch(15, `/sys/load/60s`)),
+		h.message(testBatch(5, `/sys/load/60s`)),
+	} {
+		if err := Dispatch(*msg); err != nil {
+			t.Fatalf("Dispatch: %s", err)
+		}
+	}
+
+	// the filtered message is committed as well
+	committed := map[int64]bool{}
+	for _, offset := range h.waitCommits(t, 3) {
+		committed[offset] = true
+	}
+	if !committed[outside.Offset] {
+		t.Errorf("Filtered offset %d was not committed", outside.Offset)
+	}
+	if err := result(t, outside); err != errFiltered {
+		t.Errorf("Filtered message reported %v, expected %s", err,
+			errFiltered)
+	}
+	h.stop(t)
+
+	hosts := map[string]bool{}
+	for _, msg := range p.messages() {
+		key, _ := msg.Key.Encode()
+		hosts[string(key)] = true
+	}
+	if len(hosts) != 2 || !hosts[`15`] || !hosts[`5`] {
+		t.Errorf("Produced metrics of hosts %v, expected 5 and 15", hosts)
+	}
+	filtered := metrics.GetOrRegisterMeter(`/input/filtered.per.second`,
+		*h.Metrics)
+	if n := filtered.Count(); n != 1 {
+		t.Errorf("Counted %d filtered messages, expected 1", n)
+	}
+}
+
+func TestSetHostFilterInvalid(t *testing.T) {
+	registry := metrics.NewRegistry()
+	defer SetHostFilter(nil, nil)
+	for _, ranges := range [][]string{{`10-`}, {`a`}, {`20-10`}} {
+		if err := SetHostFilter(ranges, &registry); err == nil {
+			t.Errorf("Accepted host filter %v", ranges)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
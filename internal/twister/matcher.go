@@ -0,0 +1,33 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import "strings"
+
+// NormalizePatterns returns the patterns in entries with surrounding
+// whitespace removed, as expected by the PathMatcher of lib/twister.
+// Entries may hold several comma separated patterns. Empty and
+// duplicate patterns are dropped.
+func NormalizePatterns(entries []string) []string {
+	patterns := make([]string, 0, len(entries))
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		for _, p := range strings.Split(entry, `,`) {
+			p = strings.TrimSpace(p)
+			if p == `` || seen[p] {
+				continue
+			}
+			seen[p] = true
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
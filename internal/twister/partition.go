@@ -0,0 +1,77 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"fmt"
+	"sync"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// partitions holds the per-partition meters updated by Dispatch, it is
+// nil if per-partition metrics are disabled
+var partitions *partitionMeters
+
+// SetPartitionMetrics enables meters of the consumed messages and
+// bytes per topic and partition in Dispatch
+func SetPartitionMetrics(registry *metrics.Registry) {
+	partitions = &partitionMeters{
+		registry: registry,
+		meters:   make(map[partitionKey]*partitionMeter),
+	}
+}
+
+// partitionKey identifies a consumed partition
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+// partitionMeter are the meters of a single partition
+type partitionMeter struct {
+	messages metrics.Meter
+	bytes    metrics.Meter
+}
+
+// partitionMeters registers the meters of a partition on first use
+type partitionMeters struct {
+	sync.Mutex
+	registry *metrics.Registry
+	meters   map[partitionKey]*partitionMeter
+}
+
+// mark records a message of size bytes consumed from partition of
+// topic
+func (p *partitionMeters) mark(topic string, partition int32, size int) {
+	key := partitionKey{topic: topic, partition: partition}
+
+	p.Lock()
+	m, ok := p.meters[key]
+	if !ok {
+		prefix := fmt.Sprintf("/input/partition/%s/%d", topic, partition)
+		m = &partitionMeter{
+			messages: metrics.GetOrRegisterMeter(
+				prefix+`/messages.per.second`,
+				*p.registry,
+			),
+			bytes: metrics.GetOrRegisterMeter(
+				prefix+`/bytes.per.second`,
+				*p.registry,
+			),
+		}
+		p.meters[key] = m
+	}
+	p.Unlock()
+
+	m.messages.Mark(1)
+	m.bytes.Mark(int64(size))
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
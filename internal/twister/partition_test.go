@@ -0,0 +1,55 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"fmt"
+	"testing"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+func TestDispatchPartitionMeters(t *testing.T) {
+	h := startHandler(t, newTestSettings(), newFakeProducer(nil))
+	SetPartitionMetrics(h.Metrics)
+	defer func() { partitions = nil }()
+
+	// partition 1 is hot, partition 2 receives a single message
+	sizes := map[int32]int64{}
+	for i := 0; i < 4; i++ {
+		partition := int32(1)
+		if i == 3 {
+			partition = 2
+		}
+		msg := h.message(testBatch(1, `/sys/load/60s`))
+		msg.Partition = partition
+		sizes[partition] += int64(len(msg.Value))
+		if err := Dispatch(*msg); err != nil {
+			t.Fatalf("Dispatch: %s", err)
+		}
+	}
+	h.waitCommits(t, 4)
+	h.stop(t)
+
+	for partition, expected := range map[int32]int64{1: 3, 2: 1} {
+		prefix := fmt.Sprintf("/input/partition/metrics/%d", partition)
+		messages := metrics.GetOrRegisterMeter(
+			prefix+`/messages.per.second`, *h.Metrics)
+		bytes := metrics.GetOrRegisterMeter(
+			prefix+`/bytes.per.second`, *h.Metrics)
+		if messages.Count() != expected ||
+			bytes.Count() != sizes[partition] {
+			t.Errorf("Partition %d counted %d messages of %d bytes,"+
+				" expected %d of %d bytes", partition, messages.Count(),
+				bytes.Count(), expected, sizes[partition])
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
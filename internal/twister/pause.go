@@ -0,0 +1,85 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import "sync"
+
+// pause is shared by all handlers
+var pause = &pauser{}
+
+// Pause stops the handlers from reading further consumed messages
+// until Resume is called. Messages already read are still processed
+// and committed. Dispatch blocks once the input of a handler is full,
+// which holds the consumer while it stays a member of its consumer
+// group. Pause reports if consumption was paused.
+func Pause() bool {
+	return pause.set(true)
+}
+
+// Resume continues consumption paused by Pause. It reports if
+// consumption was paused.
+func Resume() bool {
+	return pause.set(false)
+}
+
+// Paused reports if consumption is paused
+func Paused() bool {
+	pause.mutex.Lock()
+	defer pause.mutex.Unlock()
+
+	return pause.paused
+}
+
+// DisablePause resumes consumption and ignores all further calls to
+// Pause. It must be called before the consumer is shut down, since a
+// consumer blocked in Dispatch can not stop.
+func DisablePause() {
+	pause.mutex.Lock()
+	pause.disabled = true
+	pause.mutex.Unlock()
+	pause.set(false)
+}
+
+// pauser holds the paused state of the handlers
+type pauser struct {
+	mutex    sync.Mutex
+	paused   bool
+	disabled bool
+	changed  chan struct{}
+}
+
+// set updates the paused state and reports if it changed
+func (p *pauser) set(paused bool) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.paused == paused || (paused && p.disabled) {
+		return false
+	}
+	p.paused = paused
+	if p.changed != nil {
+		close(p.changed)
+		p.changed = nil
+	}
+	return true
+}
+
+// state returns the paused state and a channel that is closed once
+// it changes
+func (p *pauser) state() (bool, <-chan struct{}) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.changed == nil {
+		p.changed = make(chan struct{})
+	}
+	return p.paused, p.changed
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,76 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandlerPause(t *testing.T) {
+	if !Pause() {
+		t.Fatal(`Pause reported consumption was already paused`)
+	}
+	defer Resume()
+
+	p := newFakeProducer(nil)
+	h := startHandler(t, newTestSettings(), p)
+
+	// Dispatch does not block while the input has room
+	for hostID := 1; hostID <= 3; hostID++ {
+		if err := Dispatch(*h.message(testBatch(hostID,
+			`/sys/load/60s`))); err != nil {
+			t.Fatalf("Dispatch: %s", err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(p.messages()); n != 0 {
+		t.Errorf("Produced %d messages while paused", n)
+	}
+	if n := len(h.commits); n != 0 {
+		t.Errorf("Committed %d offsets while paused", n)
+	}
+	if n := len(h.Input); n != 3 {
+		t.Errorf("Handler read %d messages while paused", 3-n)
+	}
+
+	if !Paused() {
+		t.Error(`Paused reported consumption was not paused`)
+	}
+	if !Resume() {
+		t.Fatal(`Resume reported consumption was not paused`)
+	}
+	if Paused() {
+		t.Error(`Paused reported consumption was paused after resume`)
+	}
+	h.waitCommits(t, 3)
+	if n := len(p.messages()); n != 3 {
+		t.Errorf("Produced %d messages after resume, expected 3", n)
+	}
+	h.stop(t)
+}
+
+func TestDisablePause(t *testing.T) {
+	defer func() {
+		pause.mutex.Lock()
+		pause.disabled = false
+		pause.mutex.Unlock()
+	}()
+
+	Pause()
+	DisablePause()
+	if paused, _ := pause.state(); paused {
+		t.Error(`DisablePause did not resume consumption`)
+	}
+	if Pause() {
+		t.Error(`Pause paused consumption after DisablePause`)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
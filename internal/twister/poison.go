@@ -0,0 +1,171 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Shopify/sarama"
+	"github.com/Sirupsen/logrus"
+	"github.com/mjolnir42/erebos"
+)
+
+// NewPoisonTracker returns the detection of poison messages shared
+// by the handlers, or nil if threshold disables it. Every message a
+// handler dies on is counted in the state file at path, so the count
+// survives the restart after which the message is redelivered. Once a
+// message reached threshold failures, it is produced to the dead
+// letter topic and its offset is committed instead of processing it
+// again. Only failures caused by the message itself are counted.
+func NewPoisonTracker(threshold int, path string) (*PoisonTracker, error) {
+	if threshold <= 0 {
+		return nil, nil
+	}
+	if path == `` {
+		return nil, fmt.Errorf(
+			`Poison message detection requires a state file`)
+	}
+
+	p := &PoisonTracker{
+		threshold: threshold,
+		path:      path,
+		failures:  make(map[string]int),
+	}
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err = json.Unmarshal(data, &p.failures); err != nil {
+			return nil, fmt.Errorf("Invalid poison state file %s: %s",
+				path, err)
+		}
+	}
+	p.entries = int32(len(p.failures))
+	return p, nil
+}
+
+// PoisonTracker counts the failures per message coordinates
+type PoisonTracker struct {
+	sync.Mutex
+	threshold int
+	path      string
+	failures  map[string]int
+	// entries is the size of failures, it is read without the lock
+	// so that messages are checked without locking while no message
+	// failed
+	entries int32
+}
+
+// poisonKey returns the coordinates of msg
+func poisonKey(msg *erebos.Transport) string {
+	return fmt.Sprintf("%s/%d/%d", msg.Topic, msg.Partition, msg.Offset)
+}
+
+// record counts a failure of every message in msgs
+func (p *PoisonTracker) record(msgs ...*erebos.Transport) {
+	p.Lock()
+	defer p.Unlock()
+
+	for _, msg := range msgs {
+		p.failures[poisonKey(msg)]++
+	}
+	atomic.StoreInt32(&p.entries, int32(len(p.failures)))
+	p.save()
+}
+
+// poisoned reports if msg failed often enough to be skipped
+func (p *PoisonTracker) poisoned(msg *erebos.Transport) bool {
+	if atomic.LoadInt32(&p.entries) == 0 {
+		return false
+	}
+	p.Lock()
+	defer p.Unlock()
+
+	return p.failures[poisonKey(msg)] >= p.threshold
+}
+
+// clear forgets the failures of msg once its offset was committed
+func (p *PoisonTracker) clear(msg *erebos.Transport) {
+	if atomic.LoadInt32(&p.entries) == 0 {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+
+	key := poisonKey(msg)
+	if _, ok := p.failures[key]; !ok {
+		return
+	}
+	delete(p.failures, key)
+	atomic.StoreInt32(&p.entries, int32(len(p.failures)))
+	p.save()
+}
+
+// save writes the failure counts to the state file, the caller must
+// hold the lock. The counts are written to a temporary file that
+// replaces the state file, so a crash never leaves a partial state
+// file behind.
+func (p *PoisonTracker) save() {
+	data, err := json.Marshal(p.failures)
+	if err == nil {
+		err = writeFileAtomic(p.path, data, 0640)
+	}
+	if err != nil {
+		logrus.Errorf("Could not save poison state: %s", err)
+	}
+}
+
+// writeFileAtomic writes data to a temporary file in the directory of
+// path and renames it to path
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Chmod(perm)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// messageCaused reports if the produce error err was caused by the
+// message itself, so that producing it again after a restart fails
+// the same way. Broker and network errors are not.
+func messageCaused(err error) bool {
+	switch err.(type) {
+	case sarama.PacketEncodingError:
+		return true
+	}
+	switch err {
+	case sarama.ErrMessageSizeTooLarge,
+		sarama.ErrInvalidMessage,
+		sarama.ErrInvalidMessageSize:
+		return true
+	}
+	return false
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,164 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/mjolnir42/erebos"
+)
+
+// tempStateFile returns the path of a poison state file in a new
+// temporary directory, and a function removing the directory
+func tempStateFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir(``, `poison`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, `poison.json`), func() { os.RemoveAll(dir) }
+}
+
+func TestPoisonTrackerSurvivesRestart(t *testing.T) {
+	path, cleanup := tempStateFile(t)
+	defer cleanup()
+
+	msg := &erebos.Transport{Topic: `metrics`, Partition: 1, Offset: 7}
+	p, err := NewPoisonTracker(2, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.record(msg)
+	if p.poisoned(msg) {
+		t.Error(`Message poisoned below the threshold`)
+	}
+
+	// the tracker of the restarted twister reads the failure count
+	p, err = NewPoisonTracker(2, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.record(msg)
+	if !p.poisoned(msg) {
+		t.Error(`Message not poisoned at the threshold`)
+	}
+	p.clear(msg)
+	if p.poisoned(msg) {
+		t.Error(`Committed message still poisoned`)
+	}
+
+	// the state file is replaced, no temporary files are left
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != `poison.json` {
+		t.Errorf("State directory contains %d files", len(files))
+	}
+}
+
+func TestHandlerRecordsMessageFailuresOnly(t *testing.T) {
+	for produceErr, expected := range map[error]bool{
+		sarama.ErrMessageSizeTooLarge: true,
+		sarama.ErrLeaderNotAvailable:  false,
+	} {
+		path, cleanup := tempStateFile(t)
+		poison, err := NewPoisonTracker(1, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		produceErr := produceErr
+		p := newFakeProducer(func(*sarama.ProducerMessage) error {
+			return produceErr
+		})
+		h := newTestHandler(newTestSettings(), p)
+		h.Poison = poison
+		h.start()
+		<-h.Ready
+
+		msg := h.send(testBatch(1, `/sys/load/60s`))
+		select {
+		case <-h.Death:
+		case <-time.After(testTimeout):
+			t.Fatal(`Handler did not die`)
+		}
+		h.stop(t)
+		cleanup()
+
+		if got := poison.poisoned(msg); got != expected {
+			t.Errorf("Poisoned message after %s: %t, expected %t",
+				produceErr, got, expected)
+		}
+	}
+}
+
+func TestHandlerTruncatesPoisonDeadLetter(t *testing.T) {
+	path, cleanup := tempStateFile(t)
+	defer cleanup()
+	poison, err := NewPoisonTracker(1, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the producer rejects messages above the limit, like the broker
+	const limit = 512
+	settings := newTestSettings()
+	settings.Kafka.DeadLetterTopic = `dead`
+	settings.Kafka.ProducerMaxMessageBytes = limit
+	p := newFakeProducer(func(msg *sarama.ProducerMessage) error {
+		if msg.Value.Length() > limit {
+			return sarama.ErrMessageSizeTooLarge
+		}
+		return nil
+	})
+	h := newTestHandler(settings, p)
+	h.Poison = poison
+
+	// a poison message of exactly the limit, which does not fit the
+	// dead letter once encoded
+	value := bytes.Repeat([]byte(`x`), limit)
+	msg := h.message(value)
+	poison.record(msg)
+	h.start()
+	<-h.Ready
+	h.Input <- msg
+	h.waitCommits(t, 1)
+	h.stop(t)
+
+	produced := p.messages()
+	if len(produced) != 1 {
+		t.Fatalf("Produced %d messages, expected 1", len(produced))
+	}
+	data, _ := produced[0].Value.Encode()
+	if len(data) > limit {
+		t.Errorf("Produced dead letter of %d bytes, limit %d",
+			len(data), limit)
+	}
+	dead := deadLetter{}
+	if err := json.Unmarshal(data, &dead); err != nil {
+		t.Fatal(err)
+	}
+	if !dead.Truncated || len(dead.Data) == 0 ||
+		!bytes.HasPrefix(value, dead.Data) {
+		t.Errorf("Dead letter truncated %t with %d bytes of data",
+			dead.Truncated, len(dead.Data))
+	}
+	if poison.poisoned(msg) {
+		t.Error(`Dead lettered message still poisoned`)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
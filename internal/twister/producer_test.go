@@ -0,0 +1,139 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// fakePartitions is the number of partitions of every topic of the
+// fake producer
+const fakePartitions = 8
+
+// fakeProducer is an in-memory producer. It assigns every message a
+// partition with the hash partitioner used by the real producer, and
+// the next offset of that partition. Messages for which fail returns
+// an error are reported as failed instead.
+type fakeProducer struct {
+	mutex     sync.Mutex
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+	fail      func(*sarama.ProducerMessage) error
+	produced  []*sarama.ProducerMessage
+	offsets   map[string][]int64
+	closed    bool
+}
+
+// newFakeProducer returns a running fakeProducer
+func newFakeProducer(fail func(*sarama.ProducerMessage) error) *fakeProducer {
+	p := &fakeProducer{
+		input:     make(chan *sarama.ProducerMessage),
+		successes: make(chan *sarama.ProducerMessage),
+		errors:    make(chan *sarama.ProducerError),
+		fail:      fail,
+		offsets:   make(map[string][]int64),
+	}
+	go p.run()
+	return p
+}
+
+// run produces the input messages until the input is closed
+func (p *fakeProducer) run() {
+	partitioner := sarama.NewHashPartitioner(``)
+	for msg := range p.input {
+		if p.fail != nil {
+			if err := p.fail(msg); err != nil {
+				p.errors <- &sarama.ProducerError{Msg: msg, Err: err}
+				continue
+			}
+		}
+
+		partition, err := partitioner.Partition(msg, fakePartitions)
+		if err != nil {
+			p.errors <- &sarama.ProducerError{Msg: msg, Err: err}
+			continue
+		}
+		p.mutex.Lock()
+		offsets := p.offsets[msg.Topic]
+		if offsets == nil {
+			offsets = make([]int64, fakePartitions)
+			p.offsets[msg.Topic] = offsets
+		}
+		msg.Partition = partition
+		msg.Offset = offsets[partition]
+		offsets[partition]++
+		p.produced = append(p.produced, msg)
+		p.mutex.Unlock()
+
+		p.successes <- msg
+	}
+	close(p.successes)
+	close(p.errors)
+}
+
+// Input implements producer
+func (p *fakeProducer) Input() chan<- *sarama.ProducerMessage {
+	return p.input
+}
+
+// Successes implements producer
+func (p *fakeProducer) Successes() <-chan *sarama.ProducerMessage {
+	return p.successes
+}
+
+// Errors implements producer
+func (p *fakeProducer) Errors() <-chan *sarama.ProducerError {
+	return p.errors
+}
+
+// AsyncClose implements producer
+func (p *fakeProducer) AsyncClose() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.closed {
+		p.closed = true
+		close(p.input)
+	}
+}
+
+// Close implements producer. Like sarama.AsyncProducer, it discards
+// the pending successes and waits until all errors were read.
+func (p *fakeProducer) Close() error {
+	p.AsyncClose()
+	go func() {
+		for range p.successes {
+		}
+	}()
+	for range p.errors {
+	}
+	return nil
+}
+
+// isClosed reports if the producer was closed
+func (p *fakeProducer) isClosed() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.closed
+}
+
+// messages returns the successfully produced messages in the order
+// they were produced
+func (p *fakeProducer) messages() []*sarama.ProducerMessage {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return append([]*sarama.ProducerMessage(nil), p.produced...)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
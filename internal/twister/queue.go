@@ -0,0 +1,92 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"sync"
+
+	"github.com/solnx/legacy"
+)
+
+// job is a split metric waiting to be marshalled and produced, a
+// group of split metrics produced as one message if group is set, or
+// a dead letter if dead is set
+type job struct {
+	split      legacy.MetricSplit
+	group      []legacy.MetricSplit
+	topic      string
+	trackingID string
+	dead       *deadLetter
+}
+
+// assetID returns the AssetID of the metrics of j. Dead letters of
+// messages that were not decoded have AssetID 0.
+func (j *job) assetID() int64 {
+	switch {
+	case j.group != nil:
+		return j.group[0].AssetID
+	case j.dead != nil:
+		return j.dead.AssetID
+	}
+	return j.split.AssetID
+}
+
+// queue is an unbounded FIFO of jobs waiting to be handed to the
+// producer. It must not block process, since the handler's event
+// loop is also responsible for reading the producer's successes.
+type queue struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	items  []*job
+	closed bool
+}
+
+// newQueue returns an empty queue
+func newQueue() *queue {
+	q := &queue{}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+// push appends j to the queue
+func (q *queue) push(j *job) {
+	q.mutex.Lock()
+	q.items = append(q.items, j)
+	q.mutex.Unlock()
+	q.cond.Signal()
+}
+
+// pop returns the oldest job in the queue, blocking until one is
+// available. It returns false once the queue is closed and empty.
+func (q *queue) pop() (*job, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.items) == 0 {
+		return nil, false
+	}
+	j := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	return j, true
+}
+
+// close marks the queue as closed, jobs already in the queue can
+// still be read
+func (q *queue) close() {
+	q.mutex.Lock()
+	q.closed = true
+	q.mutex.Unlock()
+	q.cond.Broadcast()
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
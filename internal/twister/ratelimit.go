@@ -0,0 +1,87 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// limiter is the per-host rate limit used by Dispatch, it is nil if
+// rate limiting is disabled
+var limiter *hostLimiter
+
+// SetHostRateLimit enables the per-host rate limit in Dispatch. Every
+// host may send rate messages per second, with bursts of up to burst
+// messages. Messages above the limit are dropped and counted.
+func SetHostRateLimit(rate, burst int, registry *metrics.Registry) {
+	if rate <= 0 {
+		limiter = nil
+		return
+	}
+	if burst < rate {
+		burst = rate
+	}
+	limiter = &hostLimiter{
+		rate:    float64(rate),
+		burst:   float64(burst),
+		buckets: make(map[int]*bucket),
+		dropped: metrics.GetOrRegisterMeter(
+			`/input/ratelimited.per.second`,
+			*registry,
+		),
+	}
+}
+
+// hostLimiter implements a token bucket rate limit keyed by hostID
+type hostLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[int]*bucket
+	dropped metrics.Meter
+}
+
+// bucket is the token bucket of a single host
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow reports if hostID is within its rate budget and consumes
+// one token if it is
+func (l *hostLimiter) allow(hostID int) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[hostID]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[hostID] = b
+	}
+
+	// refill the bucket for the time passed since the last message
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		l.dropped.Mark(1)
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
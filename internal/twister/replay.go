@@ -0,0 +1,395 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Sirupsen/logrus"
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/twister/internal/config"
+)
+
+// ReplayOptions selects the messages to replay
+type ReplayOptions struct {
+	// Topic and Partition to read the batches from
+	Topic     string
+	Partition int
+	// From is the first offset to replay, To is the offset after the
+	// last message to replay. Both are limited to the messages in the
+	// partition.
+	From int64
+	To   int64
+	// Since and Until select the offset range by message timestamp
+	// instead of From and To if they are set
+	Since time.Time
+	Until time.Time
+	// Produce writes the split metrics to Destination instead of the
+	// output writer
+	Produce bool
+	// Destination is the topic to produce to instead of the default
+	// topic of the batches, it requires Produce
+	Destination string
+}
+
+// Flags registers the command line flags for the replay options
+func (o *ReplayOptions) Flags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Topic, `topic`, ``,
+		`Topic to read the metric batches from`)
+	fs.IntVar(&o.Partition, `partition`, 0,
+		`Partition to read the metric batches from`)
+	fs.Int64Var(&o.From, `from`, 0,
+		`First offset to replay`)
+	fs.Int64Var(&o.To, `to`, 0,
+		`Offset after the last message to replay, defaults to the end`+
+			` of the partition`)
+	fs.Var(timeFlag{&o.Since}, `since`,
+		`Replay messages from this RFC3339 timestamp on`)
+	fs.Var(timeFlag{&o.Until}, `until`,
+		`Replay messages before this RFC3339 timestamp`)
+	fs.BoolVar(&o.Produce, `produce`, false,
+		`Produce the split metrics instead of writing them to STDOUT`)
+	fs.StringVar(&o.Destination, `dest`, ``,
+		`Topic to produce to instead of the configured producer topic`)
+}
+
+// timeFlag is a flag.Value for RFC3339 timestamps
+type timeFlag struct {
+	t *time.Time
+}
+
+// String implements flag.Value
+func (f timeFlag) String() string {
+	if f.t == nil || f.t.IsZero() {
+		return ``
+	}
+	return f.t.Format(time.RFC3339)
+}
+
+// Set implements flag.Value
+func (f timeFlag) Set(s string) error {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return err
+	}
+	*f.t = t
+	return nil
+}
+
+// partitionSource is the subset of sarama.PartitionConsumer read by
+// Replay
+type partitionSource interface {
+	Messages() <-chan *sarama.ConsumerMessage
+	Errors() <-chan *sarama.ConsumerError
+	HighWaterMarkOffset() int64
+}
+
+// Replay reads the messages in the offset range [From, To) of a single
+// partition without joining the consumer group or committing any
+// offsets. The range is limited to the messages in the partition.
+// Every message is processed by a handler like a consumed message, so
+// that the replayed metrics are enriched and routed the same way. The
+// metrics are either written to w as newline delimited JSON or
+// produced. Messages that can not be decoded are logged and skipped.
+func Replay(conf *erebos.Config, settings *config.Config,
+	opts ReplayOptions, w io.Writer) error {
+	if opts.Destination != `` && !opts.Produce {
+		return fmt.Errorf(`Destination topic requires produce`)
+	}
+
+	brokers, err := DiscoverBrokers(conf, settings)
+	if err != nil {
+		return err
+	}
+	config, err := producerConfig(conf, settings)
+	if err != nil {
+		return err
+	}
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if !opts.Since.IsZero() || !opts.Until.IsZero() {
+		if err = resolveOffsets(client, &opts); err != nil {
+			return err
+		}
+	}
+	hwm, err := client.GetOffset(opts.Topic, int32(opts.Partition),
+		sarama.OffsetNewest)
+	if err != nil {
+		return err
+	}
+	if opts.To > 0 && opts.To <= opts.From {
+		return fmt.Errorf("Empty offset range %d-%d", opts.From, opts.To)
+	}
+	if !clampOffsets(&opts, hwm) {
+		logrus.Infof("No messages to replay in %s/%d before offset %d",
+			opts.Topic, opts.Partition, hwm)
+		return nil
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+
+	pc, err := consumer.ConsumePartition(opts.Topic,
+		int32(opts.Partition), opts.From)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	t := newReplayHandler(conf, settings, opts)
+	if opts.Produce {
+		t.Brokers = brokers
+	} else {
+		t.producer = newWriterProducer(w)
+	}
+	return replay(t, pc, opts)
+}
+
+// clampOffsets limits the offset range of opts to the messages before
+// the high water mark hwm. An unset or negative To replays up to hwm.
+// It returns false if there is nothing to replay.
+func clampOffsets(opts *ReplayOptions, hwm int64) bool {
+	if opts.To <= 0 || opts.To > hwm {
+		opts.To = hwm
+	}
+	if opts.From < 0 || opts.From >= hwm {
+		return false
+	}
+	return opts.From < opts.To
+}
+
+// newReplayHandler returns a handler for replaying messages. It
+// produces to the destination topic if one is set, and never runs in
+// test mode.
+func newReplayHandler(conf *erebos.Config, settings *config.Config,
+	opts ReplayOptions) *Twister {
+	replayConf := *conf
+	replaySettings := *settings
+	replaySettings.Twister.TestMode = false
+	if opts.Destination != `` {
+		replayConf.Kafka.ProducerTopic = opts.Destination
+		replaySettings.Twister.SourceTopicMap = nil
+	}
+	registry := metrics.NewRegistry()
+
+	return &Twister{
+		Num:      0,
+		Input:    make(chan *erebos.Transport, conf.Twister.HandlerQueueLength),
+		Shutdown: make(chan struct{}),
+		Ready:    make(chan struct{}),
+		Death:    make(chan error, 1),
+		Config:   &replayConf,
+		Settings: &replaySettings,
+		Metrics:  &registry,
+	}
+}
+
+// replay hands the messages of pc up to opts.To to t, and returns once
+// t processed them. t is registered as the only handler while it runs.
+func replay(t *Twister, pc partitionSource, opts ReplayOptions) error {
+	defer func(handlers map[int]erebos.Handler) {
+		Handlers = handlers
+	}(Handlers)
+	Handlers = map[int]erebos.Handler{t.Num: t}
+	stopped := make(chan struct{})
+	go func() {
+		t.Start()
+		close(stopped)
+	}()
+	select {
+	case <-t.Ready:
+	case err := <-t.Death:
+		close(t.Shutdown)
+		<-stopped
+		return err
+	}
+
+	// the offsets are committed to replay itself, the live consumer
+	// group is never touched. A nil commit requests the count.
+	commits := make(chan *erebos.Commit)
+	committed := make(chan int)
+	go func() {
+		n := 0
+		for c := range commits {
+			if c == nil {
+				committed <- n
+				return
+			}
+			n++
+		}
+	}()
+
+	var err error
+	replayed := 0
+replayloop:
+	for {
+		select {
+		case cerr := <-pc.Errors():
+			err = cerr
+			break replayloop
+		case err = <-t.Death:
+			break replayloop
+		case msg := <-pc.Messages():
+			if msg.Offset >= opts.To {
+				break replayloop
+			}
+
+			transport := &erebos.Transport{
+				Value:     msg.Value,
+				Topic:     msg.Topic,
+				Partition: msg.Partition,
+				Offset:    msg.Offset,
+				Commit:    commits,
+			}
+			if derr := decode(transport,
+				t.Settings.Twister.MaxMessageBytes); derr != nil {
+				logrus.Warnf("Skipping invalid data at offset %d: %s",
+					msg.Offset, derr.Error())
+			} else {
+				select {
+				case t.Input <- transport:
+					replayed++
+				case err = <-t.Death:
+					break replayloop
+				}
+			}
+
+			// stop at the end of the range or the partition
+			if msg.Offset+1 >= opts.To ||
+				msg.Offset+1 >= pc.HighWaterMarkOffset() {
+				break replayloop
+			}
+		}
+	}
+
+	close(t.Shutdown)
+	close(t.Input)
+	<-stopped
+	commits <- nil
+	if n := <-committed; err == nil && n < replayed {
+		err = fmt.Errorf("%d of %d messages were not replayed",
+			replayed-n, replayed)
+	}
+	return err
+}
+
+// writerProducer is a producer that writes the message values to an
+// io.Writer as newline delimited JSON
+type writerProducer struct {
+	mutex     sync.Mutex
+	w         io.Writer
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+	closed    bool
+}
+
+// newWriterProducer returns a running writerProducer writing to w
+func newWriterProducer(w io.Writer) *writerProducer {
+	p := &writerProducer{
+		w:         w,
+		input:     make(chan *sarama.ProducerMessage),
+		successes: make(chan *sarama.ProducerMessage),
+		errors:    make(chan *sarama.ProducerError),
+	}
+	go p.run()
+	return p
+}
+
+// run writes the input messages until the input is closed
+func (p *writerProducer) run() {
+	for msg := range p.input {
+		data, err := msg.Value.Encode()
+		if err == nil {
+			_, err = p.w.Write(append(data, '\n'))
+		}
+		if err != nil {
+			p.errors <- &sarama.ProducerError{Msg: msg, Err: err}
+			continue
+		}
+		p.successes <- msg
+	}
+	close(p.successes)
+	close(p.errors)
+}
+
+// Input implements producer
+func (p *writerProducer) Input() chan<- *sarama.ProducerMessage {
+	return p.input
+}
+
+// Successes implements producer
+func (p *writerProducer) Successes() <-chan *sarama.ProducerMessage {
+	return p.successes
+}
+
+// Errors implements producer
+func (p *writerProducer) Errors() <-chan *sarama.ProducerError {
+	return p.errors
+}
+
+// AsyncClose implements producer
+func (p *writerProducer) AsyncClose() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.closed {
+		p.closed = true
+		close(p.input)
+	}
+}
+
+// Close implements producer
+func (p *writerProducer) Close() error {
+	p.AsyncClose()
+	go func() {
+		for range p.successes {
+		}
+	}()
+	for range p.errors {
+	}
+	return nil
+}
+
+// resolveOffsets sets the offset range of opts from its timestamps
+func resolveOffsets(client sarama.Client, opts *ReplayOptions) error {
+	var err error
+	if !opts.Since.IsZero() {
+		if opts.From, err = client.GetOffset(opts.Topic,
+			int32(opts.Partition),
+			opts.Since.UnixNano()/int64(time.Millisecond),
+		); err != nil {
+			return err
+		}
+	}
+	if !opts.Until.IsZero() {
+		if opts.To, err = client.GetOffset(opts.Topic,
+			int32(opts.Partition),
+			opts.Until.UnixNano()/int64(time.Millisecond),
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,181 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/mjolnir42/erebos"
+)
+
+// fakePartition is a partition of a fake broker holding the batches
+// of hosts 0 to 9 at the offsets 0 to 9
+type fakePartition struct {
+	messages chan *sarama.ConsumerMessage
+	errors   chan *sarama.ConsumerError
+}
+
+// newFakePartition returns a fakePartition consumed from offset from
+func newFakePartition(from int64) *fakePartition {
+	p := &fakePartition{
+		messages: make(chan *sarama.ConsumerMessage, 10),
+		errors:   make(chan *sarama.ConsumerError),
+	}
+	for offset := from; offset < 10; offset++ {
+		p.messages <- &sarama.ConsumerMessage{
+			Value:     testBatch(int(offset), `/sys/load/60s`),
+			Topic:     `metrics`,
+			Partition: 0,
+			Offset:    offset,
+		}
+	}
+	return p
+}
+
+// Messages implements partitionSource
+func (p *fakePartition) Messages() <-chan *sarama.ConsumerMessage {
+	return p.messages
+}
+
+// Errors implements partitionSource
+func (p *fakePartition) Errors() <-chan *sarama.ConsumerError {
+	return p.errors
+}
+
+// HighWaterMarkOffset implements partitionSource
+func (p *fakePartition) HighWaterMarkOffset() int64 {
+	return 10
+}
+
+func TestReplayWindow(t *testing.T) {
+	// the handler of the live consumer group
+	live := startHandler(t, newTestSettings(), newFakeProducer(nil))
+	defer live.stop(t)
+
+	conf := &erebos.Config{}
+	conf.Kafka.ProducerTopic = `twister`
+	settings := newTestSettings()
+	settings.Twister.MetricUnits = map[string]string{
+		`/sys/load/60s`: `load`,
+	}
+	opts := ReplayOptions{Topic: `metrics`, From: 3, To: 6}
+	pc := newFakePartition(opts.From)
+
+	out := &bytes.Buffer{}
+	tw := newReplayHandler(conf, settings, opts)
+	tw.producer = newWriterProducer(out)
+	if err := replay(tw, pc, opts); err != nil {
+		t.Fatalf("replay: %s", err)
+	}
+
+	// the metrics were processed by the handler, which set their unit
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Replayed %d metrics, expected 3:\n%s", len(lines), out)
+	}
+	assets := map[float64]bool{}
+	for _, line := range lines {
+		split := []interface{}{}
+		if err := json.Unmarshal([]byte(line), &split); err != nil {
+			t.Fatalf("Invalid replayed metric %s: %s", line, err)
+		}
+		assets[split[0].(float64)] = true
+		if split[4] != `load` {
+			t.Errorf("Replayed %s, expected unit load", line)
+		}
+	}
+	if !assets[3] || !assets[4] || !assets[5] {
+		t.Errorf("Replayed assets %v, expected 3 to 5", assets)
+	}
+
+	// messages after the window were not consumed
+	if n := len(pc.messages); n != 4 {
+		t.Errorf("%d messages after the window left, expected 4", n)
+	}
+	// nothing was committed for the live consumer group
+	if n := len(live.commits); n != 0 {
+		t.Errorf("Replay committed %d offsets of the live handler", n)
+	}
+	if Handlers[0] != live.Twister {
+		t.Error(`Replay did not restore the live handlers`)
+	}
+}
+
+func TestReplayProducesToDestination(t *testing.T) {
+	conf := &erebos.Config{}
+	conf.Kafka.ProducerTopic = `twister`
+	settings := newTestSettings()
+	settings.Twister.SourceTopicMap = map[string]string{
+		`metrics`: `twister-metrics`,
+	}
+	opts := ReplayOptions{Topic: `metrics`, From: 8, To: 10,
+		Produce: true, Destination: `replayed`}
+
+	p := newFakeProducer(nil)
+	tw := newReplayHandler(conf, settings, opts)
+	tw.producer = p
+	if err := replay(tw, newFakePartition(opts.From), opts); err != nil {
+		t.Fatalf("replay: %s", err)
+	}
+
+	produced := p.messages()
+	if len(produced) != 2 {
+		t.Fatalf("Produced %d messages, expected 2", len(produced))
+	}
+	for _, msg := range produced {
+		if msg.Topic != `replayed` {
+			t.Errorf("Produced to %s, expected replayed", msg.Topic)
+		}
+	}
+	// replay works on copies of the configuration
+	if conf.Kafka.ProducerTopic != `twister` ||
+		settings.Twister.SourceTopicMap[`metrics`] != `twister-metrics` {
+		t.Error(`Replay modified the configuration`)
+	}
+}
+
+func TestReplayDestinationRequiresProduce(t *testing.T) {
+	opts := ReplayOptions{Topic: `metrics`, Destination: `replayed`}
+	err := Replay(&erebos.Config{}, newTestSettings(), opts, nil)
+	if err == nil {
+		t.Error(`Replay accepted a destination without produce`)
+	}
+}
+
+func TestClampOffsets(t *testing.T) {
+	tests := []struct {
+		from, to   int64
+		expectedTo int64
+		replay     bool
+	}{
+		{from: 0, to: 5, expectedTo: 5, replay: true},
+		{from: 0, to: 0, expectedTo: 10, replay: true},
+		{from: 5, to: 50, expectedTo: 10, replay: true},
+		{from: 5, to: -1, expectedTo: 10, replay: true},
+		{from: 10, to: 20, expectedTo: 10, replay: false},
+		{from: 15, to: 0, expectedTo: 10, replay: false},
+		{from: -1, to: 0, expectedTo: 10, replay: false},
+	}
+
+	for _, test := range tests {
+		opts := ReplayOptions{From: test.from, To: test.to}
+		replay := clampOffsets(&opts, 10)
+		if replay != test.replay || opts.To != test.expectedTo {
+			t.Errorf("clampOffsets(%d, %d) = %t with To %d, expected"+
+				" %t with To %d", test.from, test.to, replay, opts.To,
+				test.replay, test.expectedTo)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
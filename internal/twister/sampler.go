@@ -0,0 +1,37 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import "sync/atomic"
+
+const (
+	// number of occurrences of a sampled log message that are
+	// always logged
+	sampleBurst = 10
+	// after the burst, only every sampleEvery-th occurrence is logged
+	sampleEvery = 1000
+)
+
+// sampler rate limits a repetitive log message so that a flood of bad
+// input can not overwhelm the log
+type sampler struct {
+	count uint64
+}
+
+// sample registers an occurrence and reports if it should be logged,
+// together with the number of occurrences so far
+func (s *sampler) sample() (bool, uint64) {
+	c := atomic.AddUint64(&s.count, 1)
+	if c <= sampleBurst {
+		return true, c
+	}
+	return (c-sampleBurst)%sampleEvery == 0, c
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
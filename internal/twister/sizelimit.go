@@ -0,0 +1,66 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// sizer is the input message size limit used by Dispatch, it is nil
+// if the size is not limited
+var sizer *sizeLimit
+
+// SetMaxMessageBytes limits the input messages to max bytes, both as
+// consumed by Dispatch and after decompression by the handlers. Larger
+// messages are committed without decoding them, and counted. A max of
+// 0 disables the limit.
+func SetMaxMessageBytes(max int, registry *metrics.Registry) {
+	if max <= 0 {
+		sizer = nil
+		return
+	}
+	sizer = &sizeLimit{
+		max: max,
+		oversized: metrics.GetOrRegisterCounter(
+			`/input/oversized`,
+			*registry,
+		),
+	}
+}
+
+// sizeLimit counts and logs the rejected oversized messages
+type sizeLimit struct {
+	max       int
+	log       sampler
+	oversized metrics.Counter
+}
+
+// reject counts and logs the oversized msg
+func (s *sizeLimit) reject(msg *erebos.Transport) {
+	s.oversized.Inc(1)
+	if ok, n := s.log.sample(); ok {
+		logrus.Warnf("Ignoring message %s/%d/%d of more than %d bytes"+
+			" (%d oversized messages so far)", msg.Topic,
+			msg.Partition, msg.Offset, s.max, n)
+	}
+}
+
+// maxInputBytes returns the input message size limit of t, 0 if the
+// size is not limited. The limit set by SetMaxMessageBytes takes
+// precedence over the settings of t.
+func (t *Twister) maxInputBytes() int {
+	if sizer != nil {
+		return sizer.max
+	}
+	return t.Settings.Twister.MaxMessageBytes
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
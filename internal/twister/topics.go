@@ -0,0 +1,67 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/mjolnir42/erebos"
+	"github.com/solnx/twister/internal/config"
+)
+
+// ResolveConsumerTopics replaces a configured consumer topic pattern
+// with the comma separated list of matching topics known to brokers,
+// as expected by erebos.Consumer. It is an error to configure both a
+// topic list and a topic pattern, or a pattern that matches no topic.
+func ResolveConsumerTopics(conf *erebos.Config, settings *config.Config,
+	brokers []string) error {
+	if settings.Kafka.ConsumerTopicPattern == `` {
+		return nil
+	}
+	if conf.Kafka.ConsumerTopics != `` {
+		return fmt.Errorf(`Consumer topics and consumer topic` +
+			` pattern are mutually exclusive`)
+	}
+
+	pattern, err := regexp.Compile(settings.Kafka.ConsumerTopicPattern)
+	if err != nil {
+		return err
+	}
+
+	client, err := sarama.NewClient(brokers, sarama.NewConfig())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	topics, err := client.Topics()
+	if err != nil {
+		return err
+	}
+	matched := []string{}
+	for _, topic := range topics {
+		if pattern.MatchString(topic) {
+			matched = append(matched, topic)
+		}
+	}
+	if len(matched) == 0 {
+		return fmt.Errorf("No topic matches consumer topic pattern %s",
+			settings.Kafka.ConsumerTopicPattern)
+	}
+
+	sort.Strings(matched)
+	conf.Kafka.ConsumerTopics = strings.Join(matched, `,`)
+	return nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
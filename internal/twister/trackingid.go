@@ -0,0 +1,38 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"strconv"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// trackCounter derives trackingIDs from the handler number and a
+	// per-handler sequence number
+	trackCounter = `counter`
+	// trackUUID uses random UUIDs as trackingIDs
+	trackUUID = `uuid`
+)
+
+// newTrackingID returns a trackingID that is unique for the lifetime
+// of the handler. The counter scheme is the default, it does not
+// allocate a UUID per batch.
+func (t *Twister) newTrackingID() string {
+	if t.Settings.Twister.TrackingID == trackUUID {
+		// panic on entropy error
+		return uuid.Must(uuid.NewV4()).String()
+	}
+	t.trackSeq++
+	return strconv.Itoa(t.Num) + `:` +
+		strconv.FormatUint(t.trackSeq, 10)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,51 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"testing"
+)
+
+func TestTrackingIDUnique(t *testing.T) {
+	seen := map[string]bool{}
+	for _, scheme := range []string{trackCounter, trackUUID} {
+		for num := 0; num < 2; num++ {
+			settings := newTestSettings()
+			settings.Twister.TrackingID = scheme
+			tw := &Twister{Num: num, Settings: settings}
+			for i := 0; i < 1000; i++ {
+				id := tw.newTrackingID()
+				if seen[id] {
+					t.Fatalf("Handler %d returned %s trackingID %s twice",
+						num, scheme, id)
+				}
+				seen[id] = true
+			}
+		}
+	}
+}
+
+// BenchmarkTrackingID compares the allocations of the trackingID
+// schemes
+func BenchmarkTrackingID(b *testing.B) {
+	for _, scheme := range []string{trackCounter, trackUUID} {
+		b.Run(scheme, func(b *testing.B) {
+			settings := newTestSettings()
+			settings.Twister.TrackingID = scheme
+			tw := &Twister{Num: 3, Settings: settings}
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				tw.newTrackingID()
+			}
+		})
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -10,12 +10,17 @@
 package twister // import "github.com/solnx/twister/internal/twister"
 
 import (
+	"errors"
+	"sync"
+	"time"
+
 	"github.com/Shopify/sarama"
 	"github.com/Sirupsen/logrus"
 	"github.com/mjolnir42/delay"
 	"github.com/mjolnir42/erebos"
 	metrics "github.com/rcrowley/go-metrics"
-	wall "github.com/solnx/eye/lib/eye.wall"
+	"github.com/solnx/twister/internal/config"
+	libtwister "github.com/solnx/twister/lib/twister"
 )
 
 // Handlers is the registry of running application handlers
@@ -28,27 +33,115 @@ func init() {
 	Handlers = make(map[int]erebos.Handler)
 }
 
+// inflightMutex serializes the updates of the in-flight gauge, which
+// all handlers of a registry share
+var inflightMutex sync.Mutex
+
+// addInflight adds delta to the batches waiting for the producer
+func (t *Twister) addInflight(delta int64) {
+	inflightMutex.Lock()
+	t.inflight.Update(t.inflight.Value() + delta)
+	inflightMutex.Unlock()
+}
+
+// Enricher looks up the configuration IDs of metrics and receives the
+// handler's heartbeats. It is implemented by *wall.Lookup, metrics
+// without a configuration are reported with wall.ErrUnconfigured.
+type Enricher interface {
+	GetConfigurationID(lookID string) ([]string, error)
+	Heartbeat(app string, num int, data []byte)
+}
+
+var (
+	// errEmpty is reported for messages without data
+	errEmpty = errors.New(`Empty message`)
+	// errShutdown is reported for messages still waiting for the
+	// producer when the shutdown timed out
+	errShutdown = errors.New(`Shutdown timed out`)
+	// errRateLimited is reported for messages dropped by the per-host
+	// rate limit
+	errRateLimited = errors.New(`Host rate limit exceeded`)
+	// errNoAssetID is reported for batches without an AssetID in the
+	// configured batch field
+	errNoAssetID = errors.New(`Missing AssetID`)
+	// errOversized is reported for messages rejected by the maximum
+	// input message size
+	errOversized = errors.New(`Message exceeds maximum size`)
+	// errFiltered is reported for messages of hosts excluded by the
+	// host filter
+	errFiltered = errors.New(`Host filtered`)
+	// errNoHandlers is returned by Dispatch while no handlers are
+	// registered
+	errNoHandlers = errors.New(`No handlers registered`)
+)
+
 // Twister splits up read metric batches and produces the result
 type Twister struct {
-	Num      int
-	Input    chan *erebos.Transport
-	Shutdown chan struct{}
-	Death    chan error
-	Config   *erebos.Config
-	Metrics  *metrics.Registry
-	delay    *delay.Delay
-	trackID  map[string]int
-	trackACK map[string][]*erebos.Transport
-	dispatch chan<- *sarama.ProducerMessage
-	producer sarama.AsyncProducer
-	lookup   *wall.Lookup
-	lookKeys map[string]bool
+	Num        int
+	Input      chan *erebos.Transport
+	Shutdown   chan struct{}
+	Ready      chan struct{}
+	Death      chan error
+	Config     *erebos.Config
+	Settings   *config.Config
+	Metrics    *metrics.Registry
+	Brokers    []string
+	Poison     *PoisonTracker
+	delay      *delay.Delay
+	trackID    map[string]int
+	trackACK   map[string][]*erebos.Transport
+	trackTime  map[string]time.Time
+	trackSeq   uint64
+	processing string
+	retries    map[*sarama.ProducerMessage]int
+	done       *completed
+	dispatch   chan<- *sarama.ProducerMessage
+	queues     []*queue
+	pool       *delay.Delay
+	commits    *committer
+	halt       chan struct{}
+	skipped    chan string
+	producer   producer
+	lookup     Enricher
+	lookPaths  *libtwister.PathMatcher
+	invalidLog sampler
+	emptyLog   sampler
+	deadLog    sampler
+	truncLog   sampler
+	routeLog   sampler
+	zeroLog    sampler
+	shadowLog  sampler
+	assetLog   sampler
+	deadMeter  metrics.Meter
+	shadowOut  metrics.Meter
+	splitTimer metrics.Timer
+	commitTime metrics.Timer
+	dupCounter metrics.Counter
+	tagCounter metrics.Counter
+	zeroSplits metrics.Counter
+	shadowErrs metrics.Counter
+	panics     metrics.Counter
+	poisoned   metrics.Counter
+	inflight   metrics.Gauge
+	eligible   metrics.Counter
+	tagged     metrics.Counter
+	unconfig   metrics.Counter
+	lookupErrs metrics.Counter
+	fanout     metrics.Histogram
+	tombs      *tombstones
+	skew       *skew
+	maxBytes   int
 }
 
 // updateOffset updates the consumer offsets in Kafka once all
 // outstanding messages for trackingID have been processed
 func (t *Twister) updateOffset(trackingID string) {
 	if _, ok := t.trackID[trackingID]; !ok {
+		if t.done.has(trackingID) {
+			logrus.Debugf("Late success for completed trackingID: %s",
+				trackingID)
+			return
+		}
 		logrus.Warnf("Unknown trackingID: %s", trackingID)
 		return
 	}
@@ -57,26 +150,75 @@ func (t *Twister) updateOffset(trackingID string) {
 	// check if trackingID has been fully processed
 	if t.trackID[trackingID] == 0 {
 		// commit processed offsets to Zookeeper
-		acks := t.trackACK[trackingID]
-		for i := range acks {
-			t.delay.Use()
-			go func(idx int) {
-				t.commit(acks[idx])
-				t.delay.Done()
-			}(i)
+		for _, ack := range t.trackACK[trackingID] {
+			t.commit(ack, nil)
 		}
 		// cleanup offset tracking
 		delete(t.trackID, trackingID)
 		delete(t.trackACK, trackingID)
+		t.commitTime.UpdateSince(t.trackTime[trackingID])
+		delete(t.trackTime, trackingID)
+		t.done.add(trackingID)
+		t.addInflight(-1)
+	}
+}
+
+// commit marks a message as fully processed. The offset is committed
+// asynchronously, in the order of the calls to commit, after which
+// err is reported on the message's Return channel. In test mode the
+// offset is only committed if configured.
+func (t *Twister) commit(msg *erebos.Transport, err error) {
+	if t.Settings.Twister.TestMode && !t.Settings.Twister.TestModeCommit {
+		reply(msg, err)
+		return
+	}
+	t.commits.push(msg, err)
+}
+
+// fail reports err on the Return channels of all messages tracked
+// under trackingID, whose offsets will not be committed. The tracking
+// is removed on the first failure, so that further failures and late
+// successes of trackingID neither report nor commit anything.
+func (t *Twister) fail(trackingID string, err error) {
+	if _, ok := t.trackID[trackingID]; !ok {
+		return
+	}
+	for _, msg := range t.trackACK[trackingID] {
+		reply(msg, err)
+	}
+	t.untrack(trackingID)
+}
+
+// untrack removes the tracking of trackingID, if any, and marks it as
+// completed. Messages of trackingID that are still produced are then
+// ignored.
+func (t *Twister) untrack(trackingID string) {
+	if _, ok := t.trackID[trackingID]; ok {
+		delete(t.trackID, trackingID)
+		delete(t.trackACK, trackingID)
+		delete(t.trackTime, trackingID)
+		t.addInflight(-1)
 	}
+	t.done.add(trackingID)
 }
 
-// commit marks a message as fully processed
-func (t *Twister) commit(msg *erebos.Transport) {
-	msg.Commit <- &erebos.Commit{
-		Topic:     msg.Topic,
-		Partition: msg.Partition,
-		Offset:    msg.Offset,
+// reply reports the outcome of processing msg on its Return channel,
+// if the sender set one. Every message with a Return channel receives
+// exactly one value: nil once its offset was committed after all its
+// metrics were produced, or the error that prevented it. Invalid and
+// empty messages are committed and report why they were skipped. The
+// channel must be buffered or already be read from, otherwise the
+// outcome is dropped. In test mode the outcome is reported even if
+// the offset is not committed.
+func reply(msg *erebos.Transport, err error) {
+	if msg.Return == nil {
+		return
+	}
+	select {
+	case msg.Return <- err:
+	default:
+		logrus.Warnf("Dropped result for %s/%d/%d, nobody is reading"+
+			" the Return channel", msg.Topic, msg.Partition, msg.Offset)
 	}
 }
 
@@ -0,0 +1,74 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"encoding/json"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/solnx/legacy"
+)
+
+// readsAssetID reports if the AssetID is read from a batch field
+// instead of the host ID
+func (t *Twister) readsAssetID() bool {
+	field := t.Settings.Twister.AssetIDField
+	return field != `` && field != `host_id`
+}
+
+// setAssetID replaces the AssetID that Split derived from the batch's
+// host ID with the value of the configured field of the batch fields.
+// The lookup ID of a metric is derived from its AssetID, so enrichment
+// follows the replaced AssetID. Batches without a valid integer in the
+// field keep the host ID.
+func (t *Twister) setAssetID(fields map[string]json.RawMessage,
+	msgs []legacy.MetricSplit) {
+	if !t.readsAssetID() || len(msgs) == 0 {
+		return
+	}
+
+	field := t.Settings.Twister.AssetIDField
+	raw, ok := fields[field]
+	if !ok {
+		raw = []byte(`null`)
+	}
+	var assetID int64
+	err := json.Unmarshal(raw, &assetID)
+	if err == nil && assetID == 0 {
+		err = errNoAssetID
+	}
+	if err != nil {
+		if ok, n := t.assetLog.sample(); ok {
+			logrus.Warnf("Using host ID %d as AssetID, batch field %s"+
+				" is invalid: %s (%d such batches so far)",
+				msgs[0].AssetID, field, err.Error(), n)
+		}
+		return
+	}
+
+	for i := range msgs {
+		msgs[i].AssetID = assetID
+	}
+}
+
+// batchFields returns the top-level fields of the batch in data if
+// batches may request a route or carry the AssetID, and nil
+// otherwise. Both are read from the same decoded fields.
+func (t *Twister) batchFields(data []byte) map[string]json.RawMessage {
+	if len(t.Settings.Twister.RouteTopics) == 0 && !t.readsAssetID() {
+		return nil
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil
+	}
+	return fields
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
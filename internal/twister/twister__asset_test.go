@@ -0,0 +1,43 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"testing"
+)
+
+func TestHandlerRoutesAndReadsAssetID(t *testing.T) {
+	settings := newTestSettings()
+	settings.Twister.RouteTopics = []string{`twister-priority`}
+	settings.Twister.AssetIDField = `asset_id`
+	p := newFakeProducer(nil)
+	h := startHandler(t, settings, p)
+
+	batch := testBatch(1, `/sys/load/60s`)
+	h.send(append([]byte(`{"route":"twister-priority","asset_id":42,`),
+		batch[1:]...))
+	// unlisted routes and missing asset fields fall back
+	h.send(append([]byte(`{"route":"elsewhere",`), batch[1:]...))
+	h.waitCommits(t, 2)
+	h.stop(t)
+
+	// metrics of different assets may be produced in any order
+	keys := map[string]string{}
+	for _, msg := range p.messages() {
+		key, _ := msg.Key.Encode()
+		keys[msg.Topic] = string(key)
+	}
+	if len(keys) != 2 || keys[`twister-priority`] != `42` ||
+		keys[`twister`] != `1` {
+		t.Errorf("Produced keys per topic %v, expected key 42 to"+
+			" twister-priority and key 1 to twister", keys)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
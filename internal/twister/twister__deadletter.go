@@ -0,0 +1,82 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	"github.com/Sirupsen/logrus"
+)
+
+// deadLetter describes data that could not be processed. It is
+// produced to the dead letter topic if one is configured.
+type deadLetter struct {
+	Reason    string `json:"reason"`
+	Topic     string `json:"topic,omitempty"`
+	Partition int32  `json:"partition,omitempty"`
+	Offset    int64  `json:"offset,omitempty"`
+	AssetID   int64  `json:"asset_id,omitempty"`
+	Path      string `json:"path,omitempty"`
+	Data      []byte `json:"data,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// deadLetterMessage returns the producer message for d. It returns
+// nil if no dead letter topic is configured, in which case the dead
+// letter is only logged.
+func (t *Twister) deadLetterMessage(d *deadLetter, trackingID string) (*sarama.ProducerMessage, error) {
+	t.deadMeter.Mark(1)
+
+	if t.Settings.Kafka.DeadLetterTopic == `` {
+		if ok, n := t.deadLog.sample(); ok {
+			logrus.Warnf("Dropping data: %s (%d dropped so far)",
+				d.Reason, n)
+		}
+		return nil, nil
+	}
+
+	data, err := t.marshalDeadLetter(d)
+	if err != nil {
+		return nil, err
+	}
+	return &sarama.ProducerMessage{
+		Topic:    t.Settings.Kafka.DeadLetterTopic,
+		Value:    sarama.ByteEncoder(data),
+		Metadata: trackingID,
+	}, nil
+}
+
+// marshalDeadLetter returns d in the format of the dead letter topic.
+// Data that would push the dead letter over the producer's message
+// size limit is truncated to fit, since a dead letter that can not be
+// produced would stop the handler again.
+func (t *Twister) marshalDeadLetter(d *deadLetter) ([]byte, error) {
+	data, err := json.Marshal(d)
+	if err != nil || len(data) <= t.maxBytes || len(d.Data) == 0 {
+		return data, err
+	}
+
+	truncated := *d
+	truncated.Data = nil
+	truncated.Truncated = true
+	envelope, err := json.Marshal(&truncated)
+	if err != nil {
+		return nil, err
+	}
+	// the data is added as a quoted base64 string with its field name
+	room := t.maxBytes - len(envelope) - len(`,"data":""`)
+	if n := base64.StdEncoding.DecodedLen(room); n > 0 {
+		truncated.Data = d.Data[:n]
+	}
+	return json.Marshal(&truncated)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,92 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/solnx/legacy"
+)
+
+const (
+	// dedupeExact collapses metrics that are identical, including
+	// their value
+	dedupeExact = `exact`
+	// dedupeLast collapses metrics that only differ in their value,
+	// keeping the last one
+	dedupeLast = `last`
+)
+
+// dedupe removes duplicate metrics from msgs according to the
+// configured mode and returns the remaining metrics. Metrics are
+// duplicates if they share asset, path, timestamp and tags, and in
+// exact mode also their value. The first position of a metric is
+// kept, and the last duplicate wins.
+func (t *Twister) dedupe(msgs []legacy.MetricSplit) []legacy.MetricSplit {
+	exact := false
+	switch t.Settings.Twister.Dedupe {
+	case ``:
+		return msgs
+	case dedupeExact:
+		exact = true
+	}
+
+	seen := make(map[string]int, len(msgs))
+	res := msgs[:0]
+	for i := range msgs {
+		key := dedupeKey(&msgs[i], exact)
+		if idx, ok := seen[key]; ok {
+			res[idx] = msgs[i]
+			t.dupCounter.Inc(1)
+			continue
+		}
+		seen[key] = len(res)
+		res = append(res, msgs[i])
+	}
+	return res
+}
+
+// dedupeKey returns the identity of m for deduplication
+func dedupeKey(m *legacy.MetricSplit, withValue bool) string {
+	key := fmt.Sprintf("%d\x00%s\x00%d\x00%s", m.AssetID, m.Path,
+		m.TS.UnixNano(), strings.Join(m.Tags, "\x00"))
+	if withValue {
+		key = fmt.Sprintf("%s\x00%s\x00%d\x00%g\x00%s", key, m.Type,
+			m.Val.IntVal, m.Val.FlpVal, m.Val.StrVal)
+	}
+	return key
+}
+
+// compactTags removes empty and duplicate tags from tags, keeping the
+// first occurrence of every tag in order. Split metrics can share the
+// backing array of their tags, so tags is copied instead of modified.
+func compactTags(tags []string) []string {
+	seen := make(map[string]struct{}, len(tags))
+	var res []string
+	for i, tag := range tags {
+		if _, ok := seen[tag]; ok || tag == `` {
+			if res == nil {
+				res = make([]string, i, len(tags))
+				copy(res, tags[:i])
+			}
+			continue
+		}
+		seen[tag] = struct{}{}
+		if res != nil {
+			res = append(res, tag)
+		}
+	}
+	if res == nil {
+		return tags
+	}
+	return res
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
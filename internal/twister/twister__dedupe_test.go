@@ -0,0 +1,126 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/legacy"
+)
+
+// newDedupeTwister returns a handler deduplicating in mode
+func newDedupeTwister(mode string) *Twister {
+	settings := newTestSettings()
+	settings.Twister.Dedupe = mode
+	return &Twister{Settings: settings, dupCounter: metrics.NewCounter()}
+}
+
+// intSplit returns an integer metric of asset 1 at a fixed time
+func intSplit(path string, value int64) legacy.MetricSplit {
+	split := legacy.MetricSplit{
+		AssetID: 1,
+		Path:    path,
+		TS:      time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC),
+		Type:    `integer`,
+	}
+	split.Val.IntVal = value
+	return split
+}
+
+func TestDedupeExact(t *testing.T) {
+	tw := newDedupeTwister(dedupeExact)
+	msgs := tw.dedupe([]legacy.MetricSplit{
+		intSplit(`/sys/load/60s`, 1),
+		intSplit(`/sys/load/60s`, 1),
+		intSplit(`/sys/load/60s`, 2),
+		intSplit(`/sys/load/300s`, 1),
+	})
+
+	// only the identical metric is a duplicate
+	if len(msgs) != 3 {
+		t.Fatalf("Kept %d metrics, expected 3", len(msgs))
+	}
+	if msgs[0].Val.IntVal != 1 || msgs[1].Val.IntVal != 2 ||
+		msgs[2].Path != `/sys/load/300s` {
+		t.Errorf("Kept %+v, expected the distinct metrics in order", msgs)
+	}
+	if n := tw.dupCounter.Count(); n != 1 {
+		t.Errorf("Counted %d duplicates, expected 1", n)
+	}
+}
+
+func TestDedupeLast(t *testing.T) {
+	tw := newDedupeTwister(dedupeLast)
+	tagged := intSplit(`/sys/load/60s`, 5)
+	tagged.Tags = []string{`cpu0`}
+	msgs := tw.dedupe([]legacy.MetricSplit{
+		intSplit(`/sys/load/60s`, 1),
+		intSplit(`/sys/load/300s`, 1),
+		intSplit(`/sys/load/60s`, 2),
+		tagged,
+	})
+
+	// metrics differing only in their value are duplicates, the last
+	// value is kept at the first position
+	if len(msgs) != 3 {
+		t.Fatalf("Kept %d metrics, expected 3", len(msgs))
+	}
+	if msgs[0].Path != `/sys/load/60s` || msgs[0].Val.IntVal != 2 {
+		t.Errorf("Kept %+v first, expected /sys/load/60s with value 2",
+			msgs[0])
+	}
+	if msgs[1].Path != `/sys/load/300s` || len(msgs[2].Tags) != 1 {
+		t.Errorf("Kept %+v, expected the distinct metrics in order", msgs)
+	}
+	if n := tw.dupCounter.Count(); n != 1 {
+		t.Errorf("Counted %d duplicates, expected 1", n)
+	}
+}
+
+func TestDedupeDisabled(t *testing.T) {
+	tw := newDedupeTwister(``)
+	msgs := tw.dedupe([]legacy.MetricSplit{
+		intSplit(`/sys/load/60s`, 1),
+		intSplit(`/sys/load/60s`, 1),
+	})
+	if len(msgs) != 2 {
+		t.Errorf("Kept %d metrics without dedupe, expected 2", len(msgs))
+	}
+}
+
+func TestCompactTags(t *testing.T) {
+	for _, tc := range []struct {
+		tags     []string
+		expected []string
+	}{
+		{nil, nil},
+		{[]string{`a`, `b`}, []string{`a`, `b`}},
+		{[]string{`a`, `b`, `a`, ``, `c`, `b`}, []string{`a`, `b`, `c`}},
+		{[]string{``, `a`, ``}, []string{`a`}},
+		{[]string{``, ``}, []string{}},
+	} {
+		shared := append([]string(nil), tc.tags...)
+		got := compactTags(shared)
+		if strings.Join(got, `,`) != strings.Join(tc.expected, `,`) ||
+			len(got) != len(tc.expected) {
+			t.Errorf("compactTags(%q) = %q, expected %q", tc.tags, got,
+				tc.expected)
+		}
+		// the tags of other metrics may share the backing array
+		if strings.Join(shared, `,`) != strings.Join(tc.tags, `,`) {
+			t.Errorf("compactTags(%q) modified its argument to %q",
+				tc.tags, shared)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
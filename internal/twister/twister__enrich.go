@@ -0,0 +1,73 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/solnx/legacy"
+	libtwister "github.com/solnx/twister/lib/twister"
+)
+
+// enrich appends the configuration IDs in tags to the tags of m,
+// prefixed with the configured enrichment tag prefix. Tags that m
+// already has are skipped, and no more than the configured maximum
+// number of tags are appended.
+func (t *Twister) enrich(m *legacy.MetricSplit, tags []string) {
+	// split metrics can share their tags, appending must not write
+	// into the shared backing array
+	*m = libtwister.Clone(*m)
+
+	seen := make(map[string]struct{}, len(m.Tags)+len(tags))
+	for _, tag := range m.Tags {
+		seen[tag] = struct{}{}
+	}
+
+	prefix := t.Settings.Twister.EnrichmentTagPrefix
+	max := t.Settings.Twister.EnrichmentMaxTags
+	added := 0
+	for _, tag := range tags {
+		tag = prefix + tag
+		if _, ok := seen[tag]; ok {
+			continue
+		}
+		if max > 0 && added == max {
+			t.tagCounter.Inc(1)
+			if ok, n := t.truncLog.sample(); ok {
+				logrus.Warnf("Truncated enrichment of %d/%s to %d"+
+					" tags (%d truncated metrics so far)",
+					m.AssetID, m.Path, max, n)
+			}
+			return
+		}
+		seen[tag] = struct{}{}
+		m.Tags = append(m.Tags, tag)
+		added++
+	}
+}
+
+// setLabel sets the label key of m to value
+func setLabel(m *legacy.MetricSplit, key, value string) {
+	setLabels(m, map[string]string{key: value})
+}
+
+// setLabels sets the labels of m that are in set. Split metrics can
+// share their labels, so the labels of m are copied before they are
+// changed.
+func setLabels(m *legacy.MetricSplit, set map[string]string) {
+	labels := make(map[string]string, len(m.Labels)+len(set))
+	for k, v := range m.Labels {
+		labels[k] = v
+	}
+	for k, v := range set {
+		labels[k] = v
+	}
+	m.Labels = labels
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
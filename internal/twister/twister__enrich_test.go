@@ -0,0 +1,40 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEnrichSharedTags(t *testing.T) {
+	tw := &Twister{Settings: newTestSettings()}
+	tw.Settings.Twister.EnrichmentTagPrefix = `cfg:`
+
+	// both metrics of the batch share their tags, with spare capacity
+	tags := make([]string, 1, 4)
+	tags[0] = `a`
+	first, second := intSplit(`/sys/load/60s`, 1), intSplit(`/sys/load/300s`, 1)
+	first.Tags, second.Tags = tags, tags
+
+	tw.enrich(&first, []string{`1`, `2`})
+	if !reflect.DeepEqual(first.Tags, []string{`a`, `cfg:1`, `cfg:2`}) {
+		t.Errorf("Enriched tags %v, expected [a cfg:1 cfg:2]", first.Tags)
+	}
+	second.Tags = append(second.Tags, `b`)
+	if !reflect.DeepEqual(first.Tags, []string{`a`, `cfg:1`, `cfg:2`}) {
+		t.Errorf("Changing a shared metric changed the enriched tags"+
+			" to %v", first.Tags)
+	}
+	if !reflect.DeepEqual(second.Tags, []string{`a`, `b`}) {
+		t.Errorf("Enrichment changed the shared tags to %v", second.Tags)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
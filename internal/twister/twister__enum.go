@@ -0,0 +1,30 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import "github.com/solnx/legacy"
+
+// mapEnum converts a string metric to an integer metric if the enum
+// map of its path has an entry for its value. Metrics without a
+// matching entry are left unchanged.
+func (t *Twister) mapEnum(m *legacy.MetricSplit) {
+	if m.Type != `string` {
+		return
+	}
+	enum, ok := t.Settings.Twister.EnumMap[m.Path]
+	if !ok {
+		return
+	}
+	if v, ok := enum[m.Val.StrVal]; ok {
+		m.Type = `integer`
+		m.Val = legacy.MetricValue{IntVal: int64(v)}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,69 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"testing"
+
+	"github.com/solnx/legacy"
+	"github.com/solnx/twister/internal/config"
+)
+
+// stringSplit returns a string metric of path with value
+func stringSplit(path, value string) legacy.MetricSplit {
+	return legacy.MetricSplit{
+		Path: path,
+		Type: `string`,
+		Val:  legacy.MetricValue{StrVal: value},
+	}
+}
+
+func TestMapEnum(t *testing.T) {
+	settings := newTestSettings()
+	settings.Twister.EnumMap = map[string]map[string]config.Number{
+		`/sys/net/oper.state`:     {`up`: 1, `down`: 0},
+		`/sys/systemd/unit.state`: {`active`: 1, `failed`: 2},
+	}
+	tw := &Twister{Settings: settings}
+
+	for _, tc := range []struct {
+		split legacy.MetricSplit
+		value int64
+	}{
+		{stringSplit(`/sys/net/oper.state`, `up`), 1},
+		{stringSplit(`/sys/net/oper.state`, `down`), 0},
+		{stringSplit(`/sys/systemd/unit.state`, `failed`), 2},
+	} {
+		split := tc.split
+		tw.mapEnum(&split)
+		if split.Type != `integer` || split.Val.IntVal != tc.value ||
+			split.Val.StrVal != `` {
+			t.Errorf("Mapped %s %s to %s %+v, expected integer %d",
+				tc.split.Path, tc.split.Val.StrVal, split.Type,
+				split.Val, tc.value)
+		}
+	}
+
+	// unmapped values, unmapped paths and other types fall through
+	unmapped := []legacy.MetricSplit{
+		stringSplit(`/sys/net/oper.state`, `testing`),
+		stringSplit(`/sys/os/name`, `up`),
+		intSplit(`/sys/net/oper.state`, 5),
+	}
+	for _, split := range unmapped {
+		mapped := split
+		tw.mapEnum(&mapped)
+		if mapped.Type != split.Type || mapped.Val != split.Val {
+			t.Errorf("Mapped %s %s %+v to %s %+v", split.Path,
+				split.Type, split.Val, mapped.Type, mapped.Val)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -12,11 +12,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"time"
 
-	"github.com/Shopify/sarama"
 	"github.com/Sirupsen/logrus"
 	"github.com/mjolnir42/erebos"
-	uuid "github.com/satori/go.uuid"
 	wall "github.com/solnx/eye/lib/eye.wall"
 	"github.com/solnx/legacy"
 )
@@ -26,19 +25,21 @@ import (
 // and skipped.
 func (t *Twister) process(msg *erebos.Transport) {
 	if msg == nil || msg.Value == nil {
-		logrus.Warnf("Ignoring empty message from: %d", msg.HostID)
+		if ok, n := t.emptyLog.sample(); ok {
+			logrus.Warnf("Ignoring empty message from: %d"+
+				" (%d empty messages so far)", msg.HostID, n)
+		}
 		if msg != nil {
-			t.delay.Use()
-			go func() {
-				t.commit(msg)
-				t.delay.Done()
-			}()
+			t.commit(msg, errEmpty)
 		}
 		return
 	}
 
 	// handle heartbeat messages
 	if erebos.IsHeartbeat(msg) {
+		if t.lookup == nil {
+			return
+		}
 		t.delay.Use()
 		go func() {
 			t.lookup.Heartbeat(func() string {
@@ -55,67 +56,153 @@ func (t *Twister) process(msg *erebos.Transport) {
 		return
 	}
 
+	// skip messages that repeatedly stopped a handler, their offset
+	// is committed once the dead letter was produced
+	if t.Poison != nil && t.Poison.poisoned(msg) {
+		t.poisoned.Inc(1)
+		logrus.Warnf("Skipping poison message %s/%d/%d", msg.Topic,
+			msg.Partition, msg.Offset)
+		trackingID := t.newTrackingID()
+		t.enqueue(&job{
+			trackingID: trackingID,
+			dead: &deadLetter{
+				Reason:    `Poison message`,
+				Topic:     msg.Topic,
+				Partition: msg.Partition,
+				Offset:    msg.Offset,
+				Data:      msg.Value,
+			},
+		})
+		t.track(msg, trackingID, 1)
+		return
+	}
+
+	// some producers gzip the batch before producing it, Dispatch
+	// only read its HostID
+	if value, err := decompress(msg.Value, t.maxInputBytes()); err == errOversized {
+		if sizer != nil {
+			sizer.reject(msg)
+		}
+		t.commit(msg, err)
+		return
+	} else if err != nil {
+		if ok, n := t.invalidLog.sample(); ok {
+			logrus.Warnf("Ignoring invalid data: %s"+
+				" (%d invalid messages so far)", err.Error(), n)
+		}
+		t.commit(msg, err)
+		return
+	} else {
+		msg.Value = value
+	}
+
+	splitStart := time.Now()
 	batch := legacy.MetricBatch{}
 	if err := json.Unmarshal(msg.Value, &batch); err != nil {
-		logrus.Warnf("Ignoring invalid data: %s", err.Error())
-		t.delay.Use()
-		go func() {
-			t.commit(msg)
-			t.delay.Done()
-		}()
+		if ok, n := t.invalidLog.sample(); ok {
+			logrus.Warnf("Ignoring invalid data: %s"+
+				" (%d invalid messages so far)", err.Error(), n)
+		}
+		t.commit(msg, err)
 		return
 	}
 
-	// panic on entropy error
-	trackingID := uuid.Must(uuid.NewV4()).String()
+	// log the full payload of every n-th message by offset
+	if n := int64(t.Settings.Twister.DebugSampleRate); n > 0 &&
+		msg.Offset%n == 0 {
+		logrus.Debugf("Sampled message %s/%d/%d: %s", msg.Topic,
+			msg.Partition, msg.Offset, string(msg.Value))
+		logrus.Debugf("Sampled batch %s/%d/%d: %+v", msg.Topic,
+			msg.Partition, msg.Offset, batch)
+	}
+
+	trackingID := t.newTrackingID()
+	t.processing = trackingID
 	var produced int
 
+	fields := t.batchFields(msg.Value)
+	fallback := t.defaultTopic(msg, fields)
 	msgs := batch.Split()
+	t.splitTimer.UpdateSince(splitStart)
+	t.setAssetID(fields, msgs)
+	if t.skew != nil {
+		t.skew.correct(msgs)
+	}
+	msgs = t.dedupe(msgs)
+	if t.tombs != nil {
+		msgs = append(msgs, t.tombs.update(msgs, time.Now())...)
+	}
+	t.fanout.Update(int64(len(msgs)))
+	// trace produced metrics back to their input message
+	var source map[string]string
+	if t.Settings.Twister.SourceLabels {
+		source = map[string]string{
+			`src_topic`:     msg.Topic,
+			`src_partition`: strconv.Itoa(int(msg.Partition)),
+			`src_offset`:    strconv.FormatInt(msg.Offset, 10),
+		}
+	}
+
+	out := t.newRebatcher(trackingID)
 	for i := range msgs {
+		t.mapEnum(&msgs[i])
+		// Split never sets a unit, use the registered unit if any
+		if msgs[i].Unit == `` {
+			msgs[i].Unit = t.Settings.Twister.MetricUnits[msgs[i].Path]
+		}
+		// Split drops the protocol version of the batch
+		if t.Settings.Twister.ProtocolLabel && batch.Protocol != 0 {
+			setLabel(&msgs[i], `proto`, strconv.Itoa(batch.Protocol))
+		}
+		if source != nil {
+			setLabels(&msgs[i], source)
+		}
 
-		if t.lookKeys[msgs[i].Path] {
+		if t.lookPaths != nil && t.lookPaths.Match(msgs[i].Path) {
+			// count how well the enriched paths are targeted, separate
+			// from the cache statistics of the lookup itself
+			t.eligible.Inc(1)
 			if tags, err := t.lookup.GetConfigurationID(
 				msgs[i].LookupID(),
 			); err == nil {
-				msgs[i].Tags = append(msgs[i].Tags, tags...)
-			} else if err != wall.ErrUnconfigured {
+				t.tagged.Inc(1)
+				t.enrich(&msgs[i], tags)
+			} else if err == wall.ErrUnconfigured {
+				t.unconfig.Inc(1)
+			} else {
+				t.lookupErrs.Inc(1)
+				reply(msg, err)
 				t.Death <- err
 				<-t.Shutdown
 				return
 			}
 		}
-		data, err := json.Marshal(&msgs[i])
-		if err != nil {
-			logrus.Warnf("Ignoring invalid data: %s", err.Error())
-			logrus.Debugln(`Ignored data:`, msgs[i])
-			continue
-		}
-
-		t.delay.Use()
-		go func(idx int, data []byte) {
-			t.dispatch <- &sarama.ProducerMessage{
-				Topic: t.Config.Kafka.ProducerTopic,
-				Key: sarama.StringEncoder(
-					strconv.Itoa(int(msgs[idx].AssetID)),
-				),
-				Value:    sarama.ByteEncoder(data),
-				Metadata: trackingID,
-			}
-			t.delay.Done()
-		}(i, data)
-		produced++
+		msgs[i].Tags = compactTags(msgs[i].Tags)
+		out.add(msgs[i], t.topic(&msgs[i], fallback))
 	}
+	out.flush()
+	produced = out.queued
 
 	// if no metrics were produced, commit offset immediately
 	if produced == 0 {
-		go func() {
-			t.commit(msg)
-			t.delay.Done()
-		}()
+		// a steady stream of these usually means a decode regression
+		t.zeroSplits.Inc(1)
+		if ok, n := t.zeroLog.sample(); ok {
+			logrus.Warnf("Batch from %d produced no metrics"+
+				" (%d such batches so far)", batch.HostID, n)
+		}
+		t.commit(msg, nil)
 		return
 	}
-	// store offsets until AsyncProducer returns success
+	t.track(msg, trackingID, produced)
+}
+
+// track stores the offset of msg until the producer acknowledged all
+// produced messages of trackingID
+func (t *Twister) track(msg *erebos.Transport, trackingID string, produced int) {
 	t.trackID[trackingID] = produced
+	t.trackTime[trackingID] = time.Now()
+	t.addInflight(1)
 	t.trackACK[trackingID] = []*erebos.Transport{msg}
 }
 
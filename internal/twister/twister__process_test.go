@@ -0,0 +1,128 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+func TestProcessDebugSampling(t *testing.T) {
+	for rate, expected := range map[int]int{0: 0, 1: 100, 10: 10, 7: 15} {
+		restore := captureLog(logrus.DebugLevel)
+		settings := newTestSettings()
+		settings.Twister.DebugSampleRate = rate
+		h := startHandler(t, settings, newFakeProducer(nil))
+
+		for i := 0; i < 100; i++ {
+			h.send(testBatch(1, `/sys/load/60s`))
+		}
+		h.waitCommits(t, 100)
+		h.stop(t)
+		restore()
+
+		if n := logged(logrus.DebugLevel, `Sampled message`); n != expected {
+			t.Errorf("Sampled %d of 100 messages at rate %d, expected %d",
+				n, rate, expected)
+		}
+		if n := logged(logrus.DebugLevel, `Sampled batch`); n != expected {
+			t.Errorf("Sampled %d of 100 batches at rate %d, expected %d",
+				n, rate, expected)
+		}
+	}
+}
+
+func TestProcessSplitTimer(t *testing.T) {
+	h := startHandler(t, newTestSettings(), newFakeProducer(nil))
+	h.send(testBatch(1, `/sys/load/60s`, `/sys/load/300s`))
+	h.waitCommits(t, 1)
+	h.stop(t)
+
+	timer := metrics.GetOrRegisterTimer(`/input/split.duration.ns`,
+		*h.Metrics)
+	if timer.Count() < 1 {
+		t.Error(`Split timer has no samples`)
+	}
+}
+
+func TestProcessZeroSplits(t *testing.T) {
+	restore := captureLog(logrus.WarnLevel)
+	defer restore()
+
+	p := newFakeProducer(nil)
+	h := startHandler(t, newTestSettings(), p)
+	empty := h.send(testBatch(9))
+	if offsets := h.waitCommits(t, 1); offsets[0] != empty.Offset {
+		t.Errorf("Committed offset %d, expected %d", offsets[0],
+			empty.Offset)
+	}
+	if err := result(t, empty); err != nil {
+		t.Errorf("Empty batch reported %s", err)
+	}
+	h.stop(t)
+
+	counter := metrics.GetOrRegisterCounter(`/input/empty.batches`,
+		*h.Metrics)
+	if n := counter.Count(); n != 1 {
+		t.Errorf("Counted %d empty batches, expected 1", n)
+	}
+	if n := logged(logrus.WarnLevel, `Batch from 9 produced no`); n != 1 {
+		t.Errorf("Logged %d warnings for host 9, expected 1", n)
+	}
+	if n := len(p.messages()); n != 0 {
+		t.Errorf("Produced %d messages, expected none", n)
+	}
+}
+
+func TestProcessSourceLabels(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		settings := newTestSettings()
+		settings.Twister.SourceLabels = enabled
+		p := newFakeProducer(nil)
+		h := startHandler(t, settings, p)
+
+		msg := h.message(testBatch(1, `/sys/load/60s`))
+		msg.Topic = `metrics.eu`
+		msg.Partition = 3
+		msg.Offset = 42
+		h.Input <- msg
+		h.waitCommits(t, 1)
+		h.stop(t)
+
+		produced := p.messages()
+		if len(produced) != 1 {
+			t.Fatalf("Produced %d messages, expected 1", len(produced))
+		}
+		data, _ := produced[0].Value.Encode()
+		split := []interface{}{}
+		if err := json.Unmarshal(data, &split); err != nil {
+			t.Fatal(err)
+		}
+		labels, _ := split[7].(map[string]interface{})
+		expected := map[string]interface{}{
+			`src_topic`:     `metrics.eu`,
+			`src_partition`: `3`,
+			`src_offset`:    `42`,
+		}
+		if !enabled {
+			expected = nil
+		}
+		if len(labels) != len(expected) ||
+			(enabled && !reflect.DeepEqual(labels, expected)) {
+			t.Errorf("Produced labels %v with source labels %t,"+
+				" expected %v", labels, enabled, expected)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
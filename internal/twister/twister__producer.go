@@ -0,0 +1,163 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Sirupsen/logrus"
+	"github.com/mjolnir42/erebos"
+	"github.com/solnx/twister/internal/config"
+	kazoo "github.com/wvanbergen/kazoo-go"
+)
+
+// producer is the subset of sarama.AsyncProducer used by the handler.
+// A producer assigned to the handler before Start is used instead of
+// creating one, which allows running the handler against an in-memory
+// producer.
+type producer interface {
+	Input() chan<- *sarama.ProducerMessage
+	Successes() <-chan *sarama.ProducerMessage
+	Errors() <-chan *sarama.ProducerError
+	AsyncClose()
+	Close() error
+}
+
+// newProducer returns a producer configured from t.Config and
+// t.Settings. The brokers are discovered if they were not passed to
+// the handler.
+func (t *Twister) newProducer() (producer, error) {
+	brokers := t.Brokers
+	if len(brokers) == 0 {
+		var err error
+		if brokers, err = DiscoverBrokers(t.Config, t.Settings); err != nil {
+			return nil, err
+		}
+	}
+	config, err := producerConfig(t.Config, t.Settings)
+	if err != nil {
+		return nil, err
+	}
+	return sarama.NewAsyncProducer(brokers, config)
+}
+
+// DiscoverBrokers returns the Kafka brokers registered in Zookeeper.
+// Failed attempts are retried with an exponential backoff, so that
+// a briefly unavailable Zookeeper does not fail the startup.
+func DiscoverBrokers(conf *erebos.Config, settings *config.Config) ([]string, error) {
+	attempts := settings.Zookeeper.DiscoveryAttempts
+	if attempts <= 0 {
+		attempts = 5
+	}
+	backoff := time.Duration(settings.Zookeeper.DiscoveryIntervalMS) *
+		time.Millisecond
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+
+	var brokers []string
+	var err error
+	for i := 1; ; i++ {
+		if brokers, err = brokerList(conf); err == nil {
+			return brokers, nil
+		}
+		if i == attempts {
+			return nil, err
+		}
+		logrus.Warnf("Broker discovery attempt %d/%d failed: %s",
+			i, attempts, err.Error())
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// brokerList reads the list of Kafka brokers from Zookeeper
+func brokerList(conf *erebos.Config) ([]string, error) {
+	kz, err := kazoo.NewKazooFromConnectionString(
+		conf.Zookeeper.Connect, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer kz.Close()
+	return kz.BrokerList()
+}
+
+// producerConfig returns the sarama configuration for producing as
+// configured in conf and settings
+func producerConfig(conf *erebos.Config, settings *config.Config) (*sarama.Config, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	config := sarama.NewConfig()
+	// set transport keepalive
+	switch conf.Kafka.Keepalive {
+	case 0:
+		config.Net.KeepAlive = 3 * time.Second
+	default:
+		config.Net.KeepAlive = time.Duration(
+			conf.Kafka.Keepalive,
+		) * time.Millisecond
+	}
+	// set our required persistence confidence for producing
+	switch conf.Kafka.ProducerResponseStrategy {
+	case `NoResponse`:
+		config.Producer.RequiredAcks = sarama.NoResponse
+	case `WaitForLocal`:
+		config.Producer.RequiredAcks = sarama.WaitForLocal
+	case `WaitForAll`:
+		config.Producer.RequiredAcks = sarama.WaitForAll
+	default:
+		config.Producer.RequiredAcks = sarama.WaitForLocal
+	}
+
+	// set return parameters
+	config.Producer.Return.Errors = true
+	config.Producer.Return.Successes = true
+
+	// set how often to retry producing
+	switch conf.Kafka.ProducerRetry {
+	case 0:
+		config.Producer.Retry.Max = 3
+	default:
+		config.Producer.Retry.Max = conf.Kafka.ProducerRetry
+	}
+	// set how long to wait between retries
+	switch settings.Kafka.ProducerRetryBackoffMS {
+	case 0:
+		config.Producer.Retry.Backoff = 500 * time.Millisecond
+	default:
+		config.Producer.Retry.Backoff = time.Duration(
+			settings.Kafka.ProducerRetryBackoffMS,
+		) * time.Millisecond
+	}
+	config.Producer.MaxMessageBytes = maxMessageBytes(settings)
+	// messages are keyed by AssetID, all metrics of an asset must
+	// land on the same partition
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+	config.ClientID = fmt.Sprintf("twister.%s", host)
+	return config, nil
+}
+
+// maxMessageBytes returns the largest message the producer may send
+func maxMessageBytes(settings *config.Config) int {
+	if settings.Kafka.ProducerMaxMessageBytes > 0 {
+		return settings.Kafka.ProducerMaxMessageBytes
+	}
+	// sarama default
+	return 1000000
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,38 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mjolnir42/erebos"
+)
+
+func TestProducerConfigRetryBackoff(t *testing.T) {
+	for configured, expected := range map[int]time.Duration{
+		0:    500 * time.Millisecond,
+		250:  250 * time.Millisecond,
+		2000: 2 * time.Second,
+	} {
+		settings := newTestSettings()
+		settings.Kafka.ProducerRetryBackoffMS = configured
+
+		config, err := producerConfig(&erebos.Config{}, settings)
+		if err != nil {
+			t.Fatalf("producerConfig: %s", err)
+		}
+		if config.Producer.Retry.Backoff != expected {
+			t.Errorf("Retry backoff %s for %dms, expected %s",
+				config.Producer.Retry.Backoff, configured, expected)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,76 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"github.com/solnx/legacy"
+	libtwister "github.com/solnx/twister/lib/twister"
+)
+
+// rebatcher queues the split metrics of one batch. If rebatching is
+// enabled, consecutive metrics of the same asset and topic are grouped
+// into a single job of up to size metrics, which is produced as one
+// message. Otherwise every metric is queued as its own job.
+type rebatcher struct {
+	t          *Twister
+	size       int
+	trackingID string
+	pending    *job
+	queued     int
+}
+
+// newRebatcher returns a rebatcher for the batch of trackingID
+func (t *Twister) newRebatcher(trackingID string) *rebatcher {
+	return &rebatcher{
+		t:          t,
+		size:       t.Settings.Twister.RebatchSize,
+		trackingID: trackingID,
+	}
+}
+
+// add queues split for topic, or adds it to the pending group. A
+// grouped split is cloned, so the group does not share tags and labels
+// with the other metrics of the batch.
+func (r *rebatcher) add(split legacy.MetricSplit, topic string) {
+	if r.size <= 0 {
+		r.t.enqueue(&job{
+			split:      split,
+			topic:      topic,
+			trackingID: r.trackingID,
+		})
+		r.queued++
+		return
+	}
+
+	if r.pending != nil && (r.pending.topic != topic ||
+		r.pending.group[0].AssetID != split.AssetID ||
+		len(r.pending.group) == r.size) {
+		r.flush()
+	}
+	if r.pending == nil {
+		r.pending = &job{
+			topic:      topic,
+			trackingID: r.trackingID,
+			group:      make([]legacy.MetricSplit, 0, r.size),
+		}
+	}
+	r.pending.group = append(r.pending.group, libtwister.Clone(split))
+}
+
+// flush queues the pending group
+func (r *rebatcher) flush() {
+	if r.pending == nil {
+		return
+	}
+	r.t.enqueue(r.pending)
+	r.pending = nil
+	r.queued++
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
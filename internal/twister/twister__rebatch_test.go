@@ -0,0 +1,139 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// producedSizes returns the number of metrics of every produced
+// message, rebatched messages are arrays of metrics
+func producedSizes(t *testing.T, p *fakeProducer) []int {
+	sizes := []int{}
+	for _, msg := range p.messages() {
+		data, _ := msg.Value.Encode()
+		elements := []json.RawMessage{}
+		if err := json.Unmarshal(data, &elements); err != nil {
+			t.Fatal(err)
+		}
+		if len(elements) > 0 && elements[0][0] == '[' {
+			sizes = append(sizes, len(elements))
+		} else {
+			sizes = append(sizes, 1)
+		}
+	}
+	return sizes
+}
+
+func TestHandlerRebatches(t *testing.T) {
+	five := []string{`/a`, `/b`, `/c`, `/d`, `/e`}
+	tests := []struct {
+		name     string
+		size     int
+		batches  [][]byte
+		shutdown bool
+		expected []int
+	}{
+		{
+			name:     `disabled`,
+			size:     0,
+			batches:  [][]byte{testBatch(1, five[:3]...)},
+			expected: []int{1, 1, 1},
+		},
+		{
+			name:     `flush on size`,
+			size:     2,
+			batches:  [][]byte{testBatch(1, five...)},
+			expected: []int{2, 2, 1},
+		},
+		{
+			// a partial group does not wait for the next batch
+			name: `flush on age`,
+			size: 10,
+			batches: [][]byte{
+				testBatch(1, five[:3]...),
+				testBatch(1, five[3:]...),
+			},
+			expected: []int{3, 2},
+		},
+		{
+			name: `flush on shutdown`,
+			size: 4,
+			batches: [][]byte{
+				testBatch(1, five...),
+				testBatch(2, five[:2]...),
+			},
+			shutdown: true,
+			expected: []int{4, 1, 2},
+		},
+	}
+
+	for _, test := range tests {
+		settings := newTestSettings()
+		settings.Twister.RebatchSize = test.size
+		p := newFakeProducer(nil)
+		h := startHandler(t, settings, p)
+
+		for _, batch := range test.batches {
+			h.send(batch)
+		}
+		if test.shutdown {
+			h.stop(t)
+			if n := len(h.commits); n != len(test.batches) {
+				t.Errorf("%s: committed %d offsets, expected %d",
+					test.name, n, len(test.batches))
+			}
+		} else {
+			h.waitCommits(t, len(test.batches))
+			h.stop(t)
+		}
+
+		// the messages of different hosts are produced in any order
+		sizes := producedSizes(t, p)
+		sort.Ints(sizes)
+		sort.Ints(test.expected)
+		if !reflect.DeepEqual(sizes, test.expected) {
+			t.Errorf("%s: produced messages of %v metrics, expected %v",
+				test.name, sizes, test.expected)
+		}
+	}
+}
+
+func TestHandlerCommitsRebatchedAfterAck(t *testing.T) {
+	release := make(chan struct{})
+	produced := 0
+	p := newFakeProducer(func(*sarama.ProducerMessage) error {
+		// hold the acknowledgement of the second rebatched message
+		if produced++; produced == 2 {
+			<-release
+		}
+		return nil
+	})
+	settings := newTestSettings()
+	settings.Twister.RebatchSize = 2
+	h := startHandler(t, settings, p)
+
+	h.send(testBatch(1, `/a`, `/b`, `/c`))
+	time.Sleep(50 * time.Millisecond)
+	if n := len(h.commits); n != 0 {
+		t.Errorf("Committed %d offsets before all messages were acked", n)
+	}
+
+	close(release)
+	h.waitCommits(t, 1)
+	h.stop(t)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,53 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mjolnir42/erebos"
+)
+
+// safeProcess calls process for msg. A panic while processing msg is
+// recovered, logged with the message coordinates and counted, and the
+// offset of msg is committed so that the message is not redelivered.
+// Metrics of msg that were queued before the panic are still
+// produced, but their trackingID is untracked so that they neither
+// commit msg again nor count as unknown. Recovery can be disabled for
+// debugging, the panic is then counted as a failure of msg by the
+// poison message detection before it stops twister.
+func (t *Twister) safeProcess(msg *erebos.Transport) {
+	if t.Settings.Twister.DisableRecover && t.Poison != nil {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Poison.record(msg)
+				panic(r)
+			}
+		}()
+	}
+	if !t.Settings.Twister.DisableRecover {
+		defer func() {
+			if r := recover(); r != nil {
+				t.panics.Inc(1)
+				logrus.Errorf("Recovered panic processing %s/%d/%d: %v",
+					msg.Topic, msg.Partition, msg.Offset, r)
+				if t.processing != `` {
+					t.untrack(t.processing)
+					t.processing = ``
+				}
+				t.commit(msg, fmt.Errorf("Panic: %v", r))
+			}
+		}()
+	}
+	t.process(msg)
+	t.processing = ``
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,73 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// panicEnricher panics on every lookup
+type panicEnricher struct{}
+
+// GetConfigurationID implements Enricher
+func (panicEnricher) GetConfigurationID(string) ([]string, error) {
+	panic(`lookup failed`)
+}
+
+// Heartbeat implements Enricher
+func (panicEnricher) Heartbeat(string, int, []byte) {}
+
+func TestRecoverPartiallyQueuedBatch(t *testing.T) {
+	restore := captureLog(logrus.WarnLevel)
+	defer restore()
+
+	settings := newTestSettings()
+	settings.Twister.DisableLookup = false
+	p := newFakeProducer(nil)
+	h := newTestHandler(settings, p)
+	h.Config.Twister.QueryMetrics = []string{`/sys/load/300s`}
+	h.lookup = panicEnricher{}
+	h.start()
+	<-h.Ready
+
+	// the first metric is queued before the lookup of the second one
+	// panics
+	broken := h.send(testBatch(1, `/sys/load/60s`, `/sys/load/300s`))
+	valid := h.send(testBatch(1, `/sys/load/900s`))
+	if offsets := h.waitCommits(t, 2); offsets[0] != 0 || offsets[1] != 1 {
+		t.Errorf("Committed offsets %v, expected [0 1]", offsets)
+	}
+	if err := result(t, broken); err == nil {
+		t.Error(`Panicked message reported no error`)
+	}
+	if err := result(t, valid); err != nil {
+		t.Errorf("Message after the panic reported %s", err)
+	}
+	h.stop(t)
+
+	if n := len(h.commits); n != 0 {
+		t.Errorf("Committed %d further offsets", n)
+	}
+	if n := logged(logrus.WarnLevel, `Unknown trackingID`); n != 0 {
+		t.Errorf("Logged %d unknown trackingIDs", n)
+	}
+	if n := len(p.messages()); n != 2 {
+		t.Errorf("Produced %d messages, expected 2", n)
+	}
+	inflight := metrics.GetOrRegisterGauge(`/output/inflight`,
+		*h.Metrics)
+	if n := inflight.Value(); n != 0 {
+		t.Errorf("Left %d batches in flight", n)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
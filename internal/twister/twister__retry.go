@@ -0,0 +1,85 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Sirupsen/logrus"
+)
+
+// retryable reports if err is a transient broker error that may
+// succeed when the message is produced again
+func retryable(err error) bool {
+	switch err {
+	case sarama.ErrOutOfBrokers,
+		sarama.ErrNotLeaderForPartition,
+		sarama.ErrLeaderNotAvailable,
+		sarama.ErrRequestTimedOut,
+		sarama.ErrNotEnoughReplicas,
+		sarama.ErrNotEnoughReplicasAfterAppend,
+		sarama.ErrNetworkException:
+		return true
+	}
+	return false
+}
+
+// retry produces the message of a failed produce again after a backoff
+// that doubles with every attempt. It returns false if the error is
+// not retryable or the message ran out of attempts. Retries are part
+// of the worker pool, so the producer is not closed while one is
+// pending.
+func (t *Twister) retry(e *sarama.ProducerError) bool {
+	if !retryable(e.Err) {
+		return false
+	}
+	attempt := t.retries[e.Msg]
+	delete(t.retries, e.Msg)
+	if attempt >= t.Settings.Twister.ProduceRetries {
+		return false
+	}
+
+	// sarama keeps internal retry state in the message, produce a
+	// fresh copy
+	msg := &sarama.ProducerMessage{
+		Topic:    e.Msg.Topic,
+		Key:      e.Msg.Key,
+		Value:    e.Msg.Value,
+		Metadata: e.Msg.Metadata,
+	}
+	t.retries[msg] = attempt + 1
+
+	backoff := time.Second
+	if t.Settings.Twister.ProduceRetryBackoffMS > 0 {
+		backoff = time.Duration(
+			t.Settings.Twister.ProduceRetryBackoffMS,
+		) * time.Millisecond
+	}
+	backoff <<= uint(attempt)
+	logrus.Warnf("Retrying produce to %s in %s after: %s",
+		e.Msg.Topic, backoff, e.Err.Error())
+
+	t.pool.Use()
+	go func() {
+		defer t.pool.Done()
+		select {
+		case <-time.After(backoff):
+		case <-t.halt:
+			return
+		}
+		select {
+		case t.dispatch <- msg:
+		case <-t.halt:
+		}
+	}()
+	return true
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
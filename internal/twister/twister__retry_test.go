@@ -0,0 +1,51 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestHandlerRetriesFlakyProducer(t *testing.T) {
+	settings := newTestSettings()
+	settings.Twister.ProduceRetries = 1
+	settings.Twister.ProduceRetryBackoffMS = 1
+
+	// the broker is unavailable for the first attempt only
+	attempts := 0
+	p := newFakeProducer(func(*sarama.ProducerMessage) error {
+		attempts++
+		if attempts == 1 {
+			return sarama.ErrLeaderNotAvailable
+		}
+		return nil
+	})
+	h := startHandler(t, settings, p)
+
+	msg := h.send(testBatch(1, `/sys/load/60s`))
+	h.waitCommits(t, 1)
+	if err := result(t, msg); err != nil {
+		t.Errorf("Message reported %s after a retry", err)
+	}
+	select {
+	case err := <-h.Death:
+		t.Errorf("Handler died: %s", err)
+	default:
+	}
+	h.stop(t)
+
+	if n := len(p.messages()); n != 1 || attempts != 2 {
+		t.Errorf("Produced %d messages in %d attempts, expected 1 in 2",
+			n, attempts)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -9,8 +9,13 @@
 package twister // import "github.com/solnx/twister/internal/twister"
 
 import (
+	"time"
+
+	"github.com/Shopify/sarama"
 	"github.com/Sirupsen/logrus"
+	"github.com/mjolnir42/erebos"
 	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/twister/internal/config"
 )
 
 // run is the event loop for Twister
@@ -23,62 +28,181 @@ func (t *Twister) run() {
 		`/output/messages.per.second`,
 		*t.Metrics,
 	)
+	beat := metrics.GetOrRegisterMeter(
+		`/input/heartbeats.per.second`,
+		*t.Metrics,
+	)
+
+	// input is not read while maxInFlight trackingIDs are waiting for
+	// the producer, until they drained to three quarters of the limit,
+	// or while consumption is paused
+	var input chan *erebos.Transport
+	throttled := false
+	maxInFlight := maxInFlight(t.Settings)
+	lowInFlight := maxInFlight * 3 / 4
 
-	// required during shutdown
+	// required during shutdown, the closed input channel is no longer
+	// selected
+	drainInput := t.Input
 	inputEmpty := false
 	errorEmpty := false
 	successEmpty := false
 	producerClosed := false
+	queueClosed := false
+	workersDone := make(chan struct{})
+	var waitWorkers chan struct{}
+	timeout := shutdownTimeout(t.Settings)
+	var drainTimeout <-chan time.Time
+
+	// without a producer in test mode, the producer channels stay nil
+	// and are never selected
+	var producerErrors <-chan *sarama.ProducerError
+	var producerSuccesses <-chan *sarama.ProducerMessage
+	if t.producer != nil {
+		producerErrors = t.producer.Errors()
+		producerSuccesses = t.producer.Successes()
+	}
 
 runloop:
 	for {
+		if maxInFlight > 0 {
+			switch {
+			case !throttled && len(t.trackID) >= maxInFlight:
+				throttled = true
+			case throttled && len(t.trackID) <= lowInFlight:
+				throttled = false
+			}
+		}
+		paused, pauseChanged := pause.state()
+		input = t.Input
+		if throttled || paused {
+			input = nil
+		}
+
 		select {
+		case <-pauseChanged:
+			continue runloop
 		case <-t.Shutdown:
 			// received shutdown, drain input channel which will be
 			// closed by main
+			drainTimeout = time.After(timeout)
 			goto drainloop
-		case err := <-t.producer.Errors():
+		case err := <-producerErrors:
+			// shadow copies do not affect the primary processing
+			if isShadow(err.Msg) {
+				t.shadowFailed(err.Err)
+				continue runloop
+			}
+			if t.retry(err) {
+				continue runloop
+			}
+			if t.Poison != nil && messageCaused(err.Err) {
+				t.Poison.record(t.trackACK[err.Msg.Metadata.(string)]...)
+			}
+			t.fail(err.Msg.Metadata.(string), err.Err)
 			t.Death <- err
 			<-t.Shutdown
 			break runloop
-		case msg := <-t.producer.Successes():
+		case msg := <-producerSuccesses:
+			if isShadow(msg) {
+				t.shadowOut.Mark(1)
+				continue runloop
+			}
+			delete(t.retries, msg)
 			trackingID := msg.Metadata.(string)
 			t.updateOffset(trackingID)
 			out.Mark(1)
-		case msg := <-t.Input:
+		case trackingID := <-t.skipped:
+			t.updateOffset(trackingID)
+		case msg := <-input:
 			if msg == nil {
 				// this can happen if we read the closed Input channel
 				// before the closed Shutdown channel
 				continue runloop
 			}
-			t.process(msg)
-			in.Mark(1)
+			// heartbeats are not part of the data throughput
+			if erebos.IsHeartbeat(msg) {
+				beat.Mark(1)
+			} else {
+				in.Mark(1)
+			}
+			t.safeProcess(msg)
+			release(msg)
 		}
 	}
-	// shutdown due to producer error
+	// shutdown due to producer error, abandon queued messages
+	close(t.halt)
+	t.closeQueues()
+	t.pool.Wait()
 	t.producer.Close()
+	t.commits.close()
 	return
 
 drainloop:
 	for {
 		select {
-		case msg := <-t.Input:
+		case <-drainTimeout:
+			// a produce is stuck, give up on the outstanding messages
+			// for a predictable shutdown
+			logrus.Warnf("Twister handler #%d shutdown timed out with"+
+				" %d messages waiting for the producer", t.Num,
+				len(t.trackID))
+			for trackingID := range t.trackACK {
+				t.fail(trackingID, errShutdown)
+			}
+			close(t.halt)
+			t.closeQueues()
+			// keep discarding input so that Dispatch does not block
+			// until main closes the input channel
+			if !inputEmpty {
+				go func() {
+					for range t.Input {
+					}
+				}()
+			}
+			// close the producer once the workers stopped handing it
+			// messages, without waiting for the stuck produce
+			if t.producer != nil {
+				go t.abandonProducer(producerClosed, producerSuccesses,
+					producerErrors)
+			}
+			break drainloop
+		case msg := <-drainInput:
 			if msg == nil {
 				inputEmpty = true
+				drainInput = nil
 
-				if !producerClosed {
-					t.producer.Close()
-					producerClosed = true
-				}
-
-				// channels are closed
-				if inputEmpty && errorEmpty && successEmpty {
-					break drainloop
+				if !queueClosed {
+					// no further messages will be queued, the producer
+					// can be closed once the workers handed over all
+					// queued messages
+					t.closeQueues()
+					waitWorkers = workersDone
+					go func() {
+						t.pool.Wait()
+						close(workersDone)
+					}()
+					queueClosed = true
 				}
 				continue drainloop
 			}
-			t.process(msg)
-		case e := <-t.producer.Errors():
+			t.safeProcess(msg)
+			release(msg)
+		case trackingID := <-t.skipped:
+			t.updateOffset(trackingID)
+		case <-waitWorkers:
+			waitWorkers = nil
+			if t.producer == nil {
+				// test mode, nothing left to wait for
+				break drainloop
+			}
+			// Close would discard the pending successes, whose
+			// offsets are still to be committed
+			if !producerClosed {
+				t.producer.AsyncClose()
+				producerClosed = true
+			}
+		case e := <-producerErrors:
 			if e == nil {
 				errorEmpty = true
 
@@ -88,8 +212,13 @@ drainloop:
 				}
 				continue drainloop
 			}
+			if isShadow(e.Msg) {
+				t.shadowFailed(e.Err)
+				continue drainloop
+			}
 			logrus.Errorln(e)
-		case msg := <-t.producer.Successes():
+			t.fail(e.Msg.Metadata.(string), e.Err)
+		case msg := <-producerSuccesses:
 			if msg == nil {
 				successEmpty = true
 
@@ -99,12 +228,77 @@ drainloop:
 				}
 				continue drainloop
 			}
+			if isShadow(msg) {
+				t.shadowOut.Mark(1)
+				continue drainloop
+			}
+			delete(t.retries, msg)
 			trackingID := msg.Metadata.(string)
 			t.updateOffset(trackingID)
 			out.Mark(1)
 		}
 	}
-	t.delay.Wait()
+	t.commits.close()
+
+	// offsets that can not be committed in time are given up as well
+	done := make(chan struct{})
+	go func() {
+		t.delay.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logrus.Warnf("Twister handler #%d timed out committing offsets",
+			t.Num)
+	}
+}
+
+// abandonProducer closes the producer after the workers stopped, unless
+// it was already closed, and discards the results of the abandoned
+// messages until the producer shut down
+func (t *Twister) abandonProducer(closed bool,
+	successes <-chan *sarama.ProducerMessage,
+	errors <-chan *sarama.ProducerError) {
+	t.pool.Wait()
+	if !closed {
+		t.producer.AsyncClose()
+	}
+	for successes != nil || errors != nil {
+		select {
+		case _, ok := <-successes:
+			if !ok {
+				successes = nil
+			}
+		case _, ok := <-errors:
+			if !ok {
+				errors = nil
+			}
+		}
+	}
+}
+
+// shutdownTimeout returns the configured bound on draining a handler
+// during shutdown
+func shutdownTimeout(settings *config.Config) time.Duration {
+	if settings.Twister.ShutdownTimeout > 0 {
+		return time.Duration(settings.Twister.ShutdownTimeout) *
+			time.Second
+	}
+	return 30 * time.Second
+}
+
+// maxInFlight returns the configured limit on trackingIDs waiting for
+// the producer, 0 if the limit is disabled. The limit also bounds the
+// number of queued jobs, which would otherwise grow with the input.
+func maxInFlight(settings *config.Config) int {
+	switch {
+	case settings.Twister.MaxInFlight < 0:
+		return 0
+	case settings.Twister.MaxInFlight > 0:
+		return settings.Twister.MaxInFlight
+	}
+	return 1024
 }
 
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
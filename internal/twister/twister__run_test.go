@@ -0,0 +1,77 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+func TestRunHeartbeatsExcludedFromInput(t *testing.T) {
+	h := startHandler(t, newTestSettings(), newFakeProducer(nil))
+
+	for i := 0; i < 10; i++ {
+		h.Input <- erebos.NewHeartbeat()
+		if i%2 == 1 {
+			h.send(testBatch(1, `/sys/load/60s`))
+		}
+	}
+	// heartbeats are not committed, the input is read in order
+	h.waitCommits(t, 5)
+	h.stop(t)
+
+	data := metrics.GetOrRegisterMeter(`/input/messages.per.second`,
+		*h.Metrics)
+	if n := data.Count(); n != 5 {
+		t.Errorf("Counted %d data messages, expected 5", n)
+	}
+	beats := metrics.GetOrRegisterMeter(`/input/heartbeats.per.second`,
+		*h.Metrics)
+	if n := beats.Count(); n != 10 {
+		t.Errorf("Counted %d heartbeats, expected 10", n)
+	}
+}
+
+func TestRunClosesProducerOnShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	attempted := make(chan struct{}, 1)
+	p := newFakeProducer(func(*sarama.ProducerMessage) error {
+		attempted <- struct{}{}
+		<-release
+		return nil
+	})
+	settings := newTestSettings()
+	settings.Twister.ShutdownTimeout = 1
+	h := startHandler(t, settings, p)
+
+	// the first produce is stuck until the end of the test, which
+	// blocks the worker handing over the second metric
+	msg := h.send(testBatch(1, `/sys/load/60s`, `/sys/load/300s`))
+	<-attempted
+	h.stop(t)
+	if err := result(t, msg); err != errShutdown {
+		t.Errorf("Message reported %v, expected %s", err, errShutdown)
+	}
+
+	deadline := time.After(testTimeout)
+	for !p.isClosed() {
+		select {
+		case <-deadline:
+			t.Fatal(`Producer was not closed after the shutdown timeout`)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
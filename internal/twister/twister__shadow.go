@@ -0,0 +1,133 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Sirupsen/logrus"
+	"github.com/solnx/legacy"
+	libtwister "github.com/solnx/twister/lib/twister"
+)
+
+const (
+	// shadowArray produces the shadow copy in the positional array
+	// format of the primary topic
+	shadowArray = `array`
+	// shadowObject produces the shadow copy as JSON objects with named
+	// fields
+	shadowObject = `object`
+)
+
+// shadowMark is the metadata of shadow messages. It sets them apart
+// from primary messages, whose metadata is their trackingID.
+type shadowMark struct{}
+
+// objectSplit is a split metric in the shadow object format
+type objectSplit struct {
+	AssetID int64             `json:"assetID"`
+	Path    string            `json:"path"`
+	TS      string            `json:"timestamp"`
+	Type    string            `json:"type"`
+	Unit    string            `json:"unit"`
+	Value   interface{}       `json:"value"`
+	Tags    []string          `json:"tags,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// newObjectSplit returns m in the shadow object format. The shadow
+// copy does not share the tags and labels of m.
+func newObjectSplit(m *legacy.MetricSplit) objectSplit {
+	c := libtwister.Clone(*m)
+	o := objectSplit{
+		AssetID: m.AssetID,
+		Path:    m.Path,
+		TS:      m.TS.UTC().Format(time.RFC3339Nano),
+		Type:    m.Type,
+		Unit:    m.Unit,
+		Tags:    c.Tags,
+		Labels:  c.Labels,
+	}
+	switch m.Type {
+	case `integer`, `long`:
+		o.Value = m.Val.IntVal
+	case `real`:
+		o.Value = m.Val.FlpVal
+	case `string`:
+		o.Value = m.Val.StrVal
+	}
+	return o
+}
+
+// shadowMessage returns the shadow copy of j for the shadow topic, or
+// nil if no shadow topic is configured. Dead letters have no shadow
+// copy. Shadow copies never take part in offset tracking.
+func (t *Twister) shadowMessage(j *job) (*sarama.ProducerMessage, error) {
+	if t.Settings.Twister.ShadowTopic == `` || j.dead != nil {
+		return nil, nil
+	}
+
+	split := &j.split
+	if j.group != nil {
+		split = &j.group[0]
+	}
+
+	var data []byte
+	var err error
+	switch {
+	case t.Settings.Twister.ShadowFormat != shadowObject && j.group != nil:
+		data, err = marshalSplits(j.group)
+	case t.Settings.Twister.ShadowFormat != shadowObject:
+		data, err = json.Marshal(wireSplit{split})
+	case j.group != nil:
+		objects := make([]objectSplit, len(j.group))
+		for i := range j.group {
+			objects[i] = newObjectSplit(&j.group[i])
+		}
+		data, err = json.Marshal(objects)
+	default:
+		data, err = json.Marshal(newObjectSplit(split))
+	}
+	if err != nil {
+		return nil, err
+	}
+	key := strconv.Itoa(int(split.AssetID))
+
+	if size := len(key) + len(data); size > t.maxBytes {
+		return nil, fmt.Errorf("Shadow message size %d exceeds limit %d",
+			size, t.maxBytes)
+	}
+	return &sarama.ProducerMessage{
+		Topic:    t.Settings.Twister.ShadowTopic,
+		Key:      sarama.StringEncoder(key),
+		Value:    sarama.ByteEncoder(data),
+		Metadata: shadowMark{},
+	}, nil
+}
+
+// shadowFailed counts and logs a failed shadow copy
+func (t *Twister) shadowFailed(err error) {
+	t.shadowErrs.Inc(1)
+	if ok, n := t.shadowLog.sample(); ok {
+		logrus.Warnf("Shadow produce failed: %s"+
+			" (%d failed shadow produces so far)", err.Error(), n)
+	}
+}
+
+// isShadow reports if msg is a shadow copy
+func isShadow(msg *sarama.ProducerMessage) bool {
+	_, ok := msg.Metadata.(shadowMark)
+	return ok
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,102 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/twister/internal/config"
+	libtwister "github.com/solnx/twister/lib/twister"
+)
+
+// newShadowSettings returns settings producing shadow copies in the
+// object format
+func newShadowSettings() *config.Config {
+	settings := newTestSettings()
+	settings.Twister.ShadowTopic = `twister-shadow`
+	settings.Twister.ShadowFormat = shadowObject
+	return settings
+}
+
+func TestHandlerProducesShadowFormat(t *testing.T) {
+	p := newFakeProducer(nil)
+	h := startHandler(t, newShadowSettings(), p)
+	h.send(testBatch(7, `/sys/load/60s`, `/sys/load/300s`))
+	h.waitCommits(t, 1)
+	h.stop(t)
+
+	primary, shadow := map[string]bool{}, map[string]bool{}
+	for _, msg := range p.messages() {
+		data, _ := msg.Value.Encode()
+		switch msg.Topic {
+		case `twister`:
+			if err := libtwister.ValidateWireFormat(data); err != nil {
+				t.Errorf("Produced invalid metric %s: %s", data, err)
+			}
+			split := []interface{}{}
+			if err := json.Unmarshal(data, &split); err != nil {
+				t.Fatal(err)
+			}
+			primary[split[1].(string)] = true
+		case `twister-shadow`:
+			object := objectSplit{}
+			if err := json.Unmarshal(data, &object); err != nil {
+				t.Fatalf("Shadow copy %s is not an object: %s", data,
+					err)
+			}
+			if object.AssetID != 7 || object.Type != `integer` {
+				t.Errorf("Shadow copy %s, expected integer of asset 7",
+					data)
+			}
+			shadow[object.Path] = true
+		default:
+			t.Errorf("Produced to %s", msg.Topic)
+		}
+	}
+	for _, path := range []string{`/sys/load/60s`, `/sys/load/300s`} {
+		if !primary[path] || !shadow[path] {
+			t.Errorf("Produced %s to primary %t and shadow %t", path,
+				primary[path], shadow[path])
+		}
+	}
+
+	meter := metrics.GetOrRegisterMeter(`/output/shadow.per.second`,
+		*h.Metrics)
+	if n := meter.Count(); n != 2 {
+		t.Errorf("Counted %d shadow copies, expected 2", n)
+	}
+}
+
+func TestHandlerCommitsDespiteShadowFailure(t *testing.T) {
+	p := newFakeProducer(func(msg *sarama.ProducerMessage) error {
+		if msg.Topic == `twister-shadow` {
+			return errors.New(`Shadow topic unavailable`)
+		}
+		return nil
+	})
+	h := startHandler(t, newShadowSettings(), p)
+	msg := h.send(testBatch(7, `/sys/load/60s`))
+	h.waitCommits(t, 1)
+	if err := result(t, msg); err != nil {
+		t.Errorf("Message reported %s", err)
+	}
+	h.stop(t)
+
+	counter := metrics.GetOrRegisterCounter(`/output/shadow.errors`,
+		*h.Metrics)
+	if n := counter.Count(); n != 1 {
+		t.Errorf("Counted %d failed shadow copies, expected 1", n)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,62 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/solnx/legacy"
+	"github.com/solnx/twister/internal/config"
+)
+
+// skew corrects the timestamps of hosts with a known clock offset
+type skew struct {
+	global time.Duration
+	assets map[int64]time.Duration
+}
+
+// newSkew returns the timestamp correction configured in settings, or
+// nil if no correction is configured. Per-asset offsets replace the
+// global offset.
+func newSkew(settings *config.Config) (*skew, error) {
+	if settings.Twister.TimeOffset == 0 &&
+		len(settings.Twister.TimeOffsetMap) == 0 {
+		return nil, nil
+	}
+	s := &skew{
+		global: time.Duration(settings.Twister.TimeOffset) * time.Second,
+		assets: make(map[int64]time.Duration),
+	}
+	for key, offset := range settings.Twister.TimeOffsetMap {
+		assetID, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid asset in time offset"+
+				" map: %s", key)
+		}
+		s.assets[assetID] = time.Duration(offset) * time.Second
+	}
+	return s, nil
+}
+
+// correct adds the configured offset to the timestamps of msgs
+func (s *skew) correct(msgs []legacy.MetricSplit) {
+	for i := range msgs {
+		offset, ok := s.assets[msgs[i].AssetID]
+		if !ok {
+			offset = s.global
+		}
+		if offset != 0 {
+			msgs[i].TS = msgs[i].TS.Add(offset)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,150 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/solnx/legacy"
+	"github.com/solnx/twister/internal/config"
+)
+
+// tombstoneType is the metric type of the tombstones emitted for
+// metrics a host stopped reporting
+const tombstoneType = `tombstone`
+
+// wireSplit marshals a split metric in the wire format. legacy has no
+// tombstone type, so tombstones are marshalled by twister as a metric
+// with a null value.
+type wireSplit struct {
+	*legacy.MetricSplit
+}
+
+// MarshalJSON implements json.Marshaler
+func (w wireSplit) MarshalJSON() ([]byte, error) {
+	if w.Type != tombstoneType {
+		return json.Marshal(w.MetricSplit)
+	}
+	return json.Marshal([]interface{}{
+		w.AssetID,
+		w.Path,
+		w.TS.UTC().Format(time.RFC3339Nano),
+		tombstoneType,
+		w.Unit,
+		nil,
+		w.Tags,
+		w.Labels,
+	})
+}
+
+// marshalSplits returns group as array of metrics in the wire format
+func marshalSplits(group []legacy.MetricSplit) ([]byte, error) {
+	wire := make([]wireSplit, len(group))
+	for i := range group {
+		wire[i] = wireSplit{&group[i]}
+	}
+	return json.Marshal(wire)
+}
+
+// tombstones tracks the metric paths of every host, to emit
+// tombstones for paths a host stopped reporting
+type tombstones struct {
+	ttl      time.Duration
+	maxHosts int
+	hosts    map[int64]*hostPaths
+	swept    time.Time
+}
+
+// hostPaths are the metric paths of a host with the time each was last
+// reported, and the time the host was last seen
+type hostPaths struct {
+	paths map[string]time.Time
+	seen  time.Time
+}
+
+// newTombstones returns the tombstone tracking configured in settings.
+// Paths and hosts that were not reported within the TTL are forgotten,
+// and no more than the configured number of hosts are tracked.
+func newTombstones(settings *config.Config) *tombstones {
+	s := &tombstones{
+		ttl:      time.Hour,
+		maxHosts: 100000,
+		hosts:    make(map[int64]*hostPaths),
+		swept:    time.Now(),
+	}
+	if settings.Twister.TombstoneTTL > 0 {
+		s.ttl = time.Duration(settings.Twister.TombstoneTTL) * time.Second
+	}
+	if settings.Twister.TombstoneMaxHosts > 0 {
+		s.maxHosts = settings.Twister.TombstoneMaxHosts
+	}
+	return s
+}
+
+// update records the paths in msgs per host at now, and returns a
+// tombstone for every path of a host in msgs that the host has not
+// reported within the TTL. Paths missing from a single batch are not
+// tombstoned, since hosts may report their metrics in partial batches.
+// Tombstones carry the timestamp of the host's first metric in msgs.
+func (s *tombstones) update(msgs []legacy.MetricSplit, now time.Time) []legacy.MetricSplit {
+	s.sweep(now)
+
+	stamps := make(map[int64]time.Time)
+	for i := range msgs {
+		assetID := msgs[i].AssetID
+		h, ok := s.hosts[assetID]
+		if !ok {
+			// new hosts are not tracked once the limit is reached
+			if len(s.hosts) >= s.maxHosts {
+				continue
+			}
+			h = &hostPaths{paths: make(map[string]time.Time)}
+			s.hosts[assetID] = h
+		}
+		if _, ok := stamps[assetID]; !ok {
+			stamps[assetID] = msgs[i].TS
+		}
+		h.paths[msgs[i].Path] = now
+		h.seen = now
+	}
+
+	var res []legacy.MetricSplit
+	for assetID, ts := range stamps {
+		for path, seen := range s.hosts[assetID].paths {
+			if now.Sub(seen) <= s.ttl {
+				continue
+			}
+			delete(s.hosts[assetID].paths, path)
+			res = append(res, legacy.MetricSplit{
+				AssetID: assetID,
+				Path:    path,
+				TS:      ts,
+				Type:    tombstoneType,
+			})
+		}
+	}
+	return res
+}
+
+// sweep forgets all hosts that were not seen within the TTL. The hosts
+// are checked at most once a minute.
+func (s *tombstones) sweep(now time.Time) {
+	if now.Sub(s.swept) < time.Minute {
+		return
+	}
+	s.swept = now
+	for assetID, h := range s.hosts {
+		if now.Sub(h.seen) > s.ttl {
+			delete(s.hosts, assetID)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
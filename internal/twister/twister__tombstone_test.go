@@ -0,0 +1,173 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/solnx/legacy"
+	libtwister "github.com/solnx/twister/lib/twister"
+)
+
+// hostSplits returns an integer metric of assetID per path
+func hostSplits(assetID int64, paths ...string) []legacy.MetricSplit {
+	msgs := make([]legacy.MetricSplit, 0, len(paths))
+	for _, path := range paths {
+		msgs = append(msgs, legacy.MetricSplit{AssetID: assetID,
+			Path: path, TS: testTime, Type: `integer`})
+	}
+	return msgs
+}
+
+// newTestTombstones returns the tombstone tracking of a handler with
+// a TTL of one minute and at most maxHosts hosts, last swept at now
+func newTestTombstones(maxHosts int, now time.Time) *tombstones {
+	settings := newTestSettings()
+	settings.Twister.TombstoneTTL = 60
+	settings.Twister.TombstoneMaxHosts = maxHosts
+	s := newTombstones(settings)
+	s.swept = now
+	return s
+}
+
+func TestTombstonesAfterTTL(t *testing.T) {
+	now := time.Now()
+	s := newTestTombstones(0, now)
+
+	steps := []struct {
+		after    time.Duration
+		paths    []string
+		expected []string
+	}{
+		{0, []string{`/a`, `/b`, `/c`}, nil},
+		// partial batches of a live host emit no tombstones
+		{30 * time.Second, []string{`/a`}, nil},
+		{45 * time.Second, []string{`/a`, `/c`}, nil},
+		// /b was last reported more than a minute ago
+		{61 * time.Second, []string{`/a`}, []string{`/b`}},
+		{62 * time.Second, []string{`/a`}, nil},
+		{106 * time.Second, []string{`/a`}, []string{`/c`}},
+	}
+	for _, step := range steps {
+		res := s.update(hostSplits(3, step.paths...), now.Add(step.after))
+		var paths []string
+		for i := range res {
+			paths = append(paths, res[i].Path)
+			if res[i].Type != tombstoneType || res[i].AssetID != 3 ||
+				!res[i].TS.Equal(testTime) {
+				t.Errorf("After %s: emitted %+v", step.after, res[i])
+			}
+			data, err := marshalSplits(res[i : i+1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			group := []json.RawMessage{}
+			if err := json.Unmarshal(data, &group); err != nil {
+				t.Fatal(err)
+			}
+			if err := libtwister.ValidateWireFormat(group[0]); err != nil {
+				t.Errorf("Emitted invalid tombstone %s: %s", group[0], err)
+			}
+		}
+		sort.Strings(paths)
+		if !reflect.DeepEqual(paths, step.expected) {
+			t.Errorf("After %s: emitted tombstones for %v, expected %v",
+				step.after, paths, step.expected)
+		}
+	}
+}
+
+func TestTombstonesSweep(t *testing.T) {
+	now := time.Now()
+	s := newTestTombstones(0, now)
+
+	s.update(hostSplits(1, `/a`, `/b`), now)
+	s.update(hostSplits(2, `/a`), now.Add(30*time.Second))
+	s.update(hostSplits(3, `/a`), now.Add(40*time.Second))
+	// the sweep forgets host 1, which was not seen within the TTL
+	s.update(hostSplits(2, `/a`), now.Add(90*time.Second))
+	if _, ok := s.hosts[1]; ok || len(s.hosts) != 2 {
+		t.Errorf("Tracked %d hosts after the sweep, expected hosts 2"+
+			" and 3", len(s.hosts))
+	}
+	// the returning host starts over, without tombstones
+	if res := s.update(hostSplits(1, `/a`),
+		now.Add(91*time.Second)); len(res) != 0 {
+		t.Errorf("Emitted %d tombstones for a swept host", len(res))
+	}
+
+	// hosts are swept at most once a minute, host 3 is kept until the
+	// next sweep
+	s.update(hostSplits(2, `/a`), now.Add(140*time.Second))
+	if _, ok := s.hosts[3]; !ok {
+		t.Error(`Swept host 3 within a minute of the last sweep`)
+	}
+	s.update(hostSplits(2, `/a`), now.Add(150*time.Second))
+	if _, ok := s.hosts[3]; ok {
+		t.Error(`Host 3 was not swept`)
+	}
+}
+
+func TestTombstonesMaxHosts(t *testing.T) {
+	now := time.Now()
+	s := newTestTombstones(2, now)
+
+	for assetID := int64(1); assetID <= 3; assetID++ {
+		s.update(hostSplits(assetID, `/a`, `/b`), now)
+	}
+	if len(s.hosts) != 2 {
+		t.Errorf("Tracked %d hosts, expected 2", len(s.hosts))
+	}
+	// the untracked host emits no tombstones
+	s.update(hostSplits(1, `/a`), now.Add(30*time.Second))
+	later := now.Add(61 * time.Second)
+	if res := s.update(hostSplits(3, `/a`), later); len(res) != 0 {
+		t.Errorf("Emitted %d tombstones for an untracked host", len(res))
+	}
+	if res := s.update(hostSplits(1, `/a`), later); len(res) != 1 {
+		t.Errorf("Emitted %d tombstones for a tracked host, expected 1",
+			len(res))
+	}
+}
+
+func TestMarshalSplitsTombstone(t *testing.T) {
+	ts := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	metric := legacy.MetricSplit{AssetID: 3, Path: `/sys/load/60s`,
+		TS: ts, Type: `integer`}
+	tombstone := legacy.MetricSplit{AssetID: 3, Path: `/sys/load/300s`,
+		TS: ts, Type: tombstoneType, Tags: []string{`cpu0`}}
+
+	data, err := marshalSplits([]legacy.MetricSplit{metric, tombstone})
+	if err != nil {
+		t.Fatalf("marshalSplits: %s", err)
+	}
+	group := []json.RawMessage{}
+	if err = json.Unmarshal(data, &group); err != nil {
+		t.Fatalf("Invalid group %s: %s", data, err)
+	}
+	if len(group) != 2 {
+		t.Fatalf("Marshalled %d metrics, expected 2", len(group))
+	}
+	for _, m := range group {
+		if err = libtwister.ValidateWireFormat(m); err != nil {
+			t.Errorf("Marshalled invalid metric %s: %s", m, err)
+		}
+	}
+	expected := `[3,"/sys/load/300s","2017-06-01T12:00:00Z","tombstone",` +
+		`"",null,["cpu0"],null]`
+	if string(group[1]) != expected {
+		t.Errorf("Marshalled tombstone %s, expected %s", group[1], expected)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
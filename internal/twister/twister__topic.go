@@ -0,0 +1,107 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mjolnir42/erebos"
+	"github.com/solnx/legacy"
+)
+
+// topic returns the producer topic for split. With more than one
+// topic shard, the routed topic is only the base name of the shard
+// topics, and the AssetID of split selects the shard. All metrics of
+// an asset are produced to the same shard.
+func (t *Twister) topic(split *legacy.MetricSplit, fallback string) string {
+	topic := t.routeTopic(split, fallback)
+	if shards := int64(t.Settings.Twister.TopicShards); shards > 1 {
+		shard := split.AssetID % shards
+		if shard < 0 {
+			shard = -shard
+		}
+		return fmt.Sprintf("%s-%d", topic, shard)
+	}
+	return topic
+}
+
+// routeTopic returns the routed producer topic for split. The first
+// matching rule selects the topic:
+//
+//  1. the value of the tenant label in the tenant topic map
+//  2. the longest matching path prefix in the prefix topic map
+//  3. the metric type in the type topic map
+//
+// Splits matching no rule are produced to the default topic of their
+// batch.
+func (t *Twister) routeTopic(split *legacy.MetricSplit, fallback string) string {
+	if t.Settings.Twister.TenantLabel != `` {
+		if tenant, ok := split.Labels[t.Settings.Twister.TenantLabel]; ok {
+			if topic, ok := t.Settings.Twister.TenantTopicMap[tenant]; ok {
+				return topic
+			}
+		}
+	}
+
+	var match, matchTopic string
+	for prefix, topic := range t.Settings.Twister.PrefixTopicMap {
+		if strings.HasPrefix(split.Path, prefix) &&
+			len(prefix) > len(match) {
+			match, matchTopic = prefix, topic
+		}
+	}
+	if match != `` {
+		return matchTopic
+	}
+
+	if topic, ok := t.Settings.Twister.TypeTopicMap[split.Type]; ok {
+		return topic
+	}
+	return fallback
+}
+
+// defaultTopic returns the default producer topic for the batch in
+// msg. The consumed topic selects the default via the source topic
+// map, unmapped topics use the producer topic. A batch may replace the
+// default with one of the configured route topics in its route field,
+// which is read from the batch fields.
+func (t *Twister) defaultTopic(msg *erebos.Transport,
+	fields map[string]json.RawMessage) string {
+	fallback, ok := t.Settings.Twister.SourceTopicMap[msg.Topic]
+	if !ok {
+		fallback = t.Config.Kafka.ProducerTopic
+	}
+	if len(t.Settings.Twister.RouteTopics) == 0 {
+		return fallback
+	}
+
+	raw, ok := fields[`route`]
+	if !ok {
+		return fallback
+	}
+	var route string
+	if err := json.Unmarshal(raw, &route); err != nil || route == `` {
+		return fallback
+	}
+	for _, topic := range t.Settings.Twister.RouteTopics {
+		if route == topic {
+			return topic
+		}
+	}
+	if ok, n := t.routeLog.sample(); ok {
+		logrus.Warnf("Ignoring route to unlisted topic %s"+
+			" (%d ignored routes so far)", route, n)
+	}
+	return fallback
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,197 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"testing"
+
+	"github.com/solnx/legacy"
+)
+
+// newRoutingTwister returns a handler routing string metrics and the
+// /sys/ and /sys/disk/ trees to topics of their own
+func newRoutingTwister() *Twister {
+	settings := newTestSettings()
+	settings.Twister.TypeTopicMap = map[string]string{
+		`string`: `twister-strings`,
+	}
+	settings.Twister.PrefixTopicMap = map[string]string{
+		`/sys/`:      `twister-sys`,
+		`/sys/disk/`: `twister-disk`,
+	}
+	return &Twister{Settings: settings}
+}
+
+func TestRouteTopicByType(t *testing.T) {
+	tw := newRoutingTwister()
+	for typ, expected := range map[string]string{
+		`string`:  `twister-strings`,
+		`integer`: `twister`,
+		`real`:    `twister`,
+	} {
+		split := &legacy.MetricSplit{Path: `/os/kernel`, Type: typ}
+		if got := tw.routeTopic(split, `twister`); got != expected {
+			t.Errorf("Routed %s metric to %s, expected %s", typ, got,
+				expected)
+		}
+	}
+}
+
+func TestRouteTopicByPrefix(t *testing.T) {
+	tw := newRoutingTwister()
+	for path, expected := range map[string]string{
+		`/sys/load/60s`:    `twister-sys`,
+		`/sys/disk/sda/io`: `twister-disk`,
+		`/system/uptime`:   `twister`,
+		`/net/rx`:          `twister`,
+	} {
+		split := &legacy.MetricSplit{Path: path, Type: `integer`}
+		if got := tw.routeTopic(split, `twister`); got != expected {
+			t.Errorf("Routed %s to %s, expected %s", path, got, expected)
+		}
+	}
+
+	// the path prefix takes precedence over the type
+	split := &legacy.MetricSplit{Path: `/sys/hostname`, Type: `string`}
+	if got := tw.routeTopic(split, `twister`); got != `twister-sys` {
+		t.Errorf("Routed string /sys/hostname to %s, expected twister-sys",
+			got)
+	}
+}
+
+func TestRouteTopicByTenant(t *testing.T) {
+	tw := newRoutingTwister()
+	tw.Settings.Twister.TenantLabel = `tenant`
+	tw.Settings.Twister.TenantTopicMap = map[string]string{
+		`acme`: `twister-acme`,
+	}
+
+	tests := []struct {
+		labels   map[string]string
+		path     string
+		expected string
+	}{
+		// the tenant topic overrides the default topic, and the
+		// path and type rules
+		{map[string]string{`tenant`: `acme`}, `/net/rx`, `twister-acme`},
+		{map[string]string{`tenant`: `acme`}, `/sys/load/60s`,
+			`twister-acme`},
+		// unknown, empty and missing tenants use the other rules
+		{map[string]string{`tenant`: `initech`}, `/net/rx`, `twister`},
+		{map[string]string{`tenant`: `initech`}, `/sys/load/60s`,
+			`twister-sys`},
+		{map[string]string{`tenant`: ``}, `/net/rx`, `twister`},
+		{map[string]string{`team`: `acme`}, `/net/rx`, `twister`},
+		{nil, `/net/rx`, `twister`},
+	}
+	for _, test := range tests {
+		split := &legacy.MetricSplit{Path: test.path, Type: `integer`,
+			Labels: test.labels}
+		if got := tw.routeTopic(split, `twister`); got != test.expected {
+			t.Errorf("Routed %s with labels %v to %s, expected %s",
+				test.path, test.labels, got, test.expected)
+		}
+	}
+}
+
+func TestTopicShards(t *testing.T) {
+	tw := newRoutingTwister()
+	tw.Settings.Twister.TopicShards = 4
+
+	// every asset, by default its host, stays on one shard of the
+	// routed topic
+	for assetID, expected := range map[int64]string{
+		1: `twister-1`, 4: `twister-0`, 7: `twister-3`, -6: `twister-2`,
+	} {
+		for i := 0; i < 3; i++ {
+			split := &legacy.MetricSplit{AssetID: assetID,
+				Path: `/net/rx`, Type: `integer`}
+			if got := tw.topic(split, `twister`); got != expected {
+				t.Errorf("Sharded asset %d to %s, expected %s", assetID,
+					got, expected)
+			}
+		}
+	}
+	split := &legacy.MetricSplit{AssetID: 5, Path: `/sys/load/60s`}
+	if got := tw.topic(split, `twister`); got != `twister-sys-1` {
+		t.Errorf("Sharded /sys/load/60s to %s, expected twister-sys-1",
+			got)
+	}
+
+	// without more than one shard, the routed topic is used
+	for _, shards := range []int{0, 1} {
+		tw.Settings.Twister.TopicShards = shards
+		split := &legacy.MetricSplit{AssetID: 7, Path: `/net/rx`}
+		if got := tw.topic(split, `twister`); got != `twister` {
+			t.Errorf("Produced to %s with %d shards, expected twister",
+				got, shards)
+		}
+	}
+}
+
+func TestHandlerCommitsAfterAllRoutedTopics(t *testing.T) {
+	p := newFakeProducer(nil)
+	h := startHandler(t, newRoutingTwister().Settings, p)
+
+	h.send([]byte(`{"host_id":3,"protocol":1,"data":[{` +
+		`"time":"2017-06-01T12:00:00Z",` +
+		`"metrics":[{"metric":"/sys/load/60s","subtype":"","value":1},` +
+		`{"metric":"/net/rx","subtype":"","value":2}],` +
+		`"stringmetrics":[{"metric":"/os/kernel","subtype":"",` +
+		`"value":"4.9"}]}]}`))
+	h.waitCommits(t, 1)
+
+	topics := map[string]int{}
+	for _, msg := range p.messages() {
+		topics[msg.Topic]++
+	}
+	for _, topic := range []string{`twister`, `twister-sys`,
+		`twister-strings`} {
+		if topics[topic] != 1 {
+			t.Errorf("Produced %d messages to %s before the commit,"+
+				" expected 1", topics[topic], topic)
+		}
+	}
+
+	h.stop(t)
+}
+
+func TestHandlerMapsSourceTopics(t *testing.T) {
+	settings := newTestSettings()
+	settings.Twister.SourceTopicMap = map[string]string{
+		`tenantA.metrics`: `tenantA.split`,
+		`tenantB.metrics`: `tenantB.split`,
+	}
+	p := newFakeProducer(nil)
+	h := startHandler(t, settings, p)
+
+	for _, topic := range []string{`tenantA.metrics`, `tenantB.metrics`,
+		`metrics`} {
+		msg := h.message(testBatch(1, `/sys/load/60s`))
+		msg.Topic = topic
+		h.Input <- msg
+	}
+	h.waitCommits(t, 3)
+	h.stop(t)
+
+	topics := map[string]int{}
+	for _, msg := range p.messages() {
+		topics[msg.Topic]++
+	}
+	// unmapped topics produce to the producer topic
+	for _, topic := range []string{`tenantA.split`, `tenantB.split`,
+		`twister`} {
+		if topics[topic] != 1 {
+			t.Errorf("Produced %d messages to %s, expected 1",
+				topics[topic], topic)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,157 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/Shopify/sarama"
+	"github.com/Sirupsen/logrus"
+)
+
+// enqueue queues j for the worker of its asset. All metrics of an
+// asset are handed to the producer by the same worker, in the order
+// they were queued.
+func (t *Twister) enqueue(j *job) {
+	n := j.assetID() % int64(len(t.queues))
+	if n < 0 {
+		n = -n
+	}
+	t.queues[n].push(j)
+}
+
+// closeQueues closes the queues of all workers
+func (t *Twister) closeQueues() {
+	for _, q := range t.queues {
+		q.close()
+	}
+}
+
+// worker marshals the metrics queued in q and hands them to the
+// producer until q is closed and empty, or the handler is halted
+func (t *Twister) worker(q *queue) {
+	defer t.pool.Done()
+
+	for {
+		j, ok := q.pop()
+		if !ok {
+			return
+		}
+
+		msg, err := t.encode(j)
+		if err != nil {
+			if ok, n := t.invalidLog.sample(); ok {
+				logrus.Warnf("Ignoring invalid data: %s"+
+					" (%d invalid messages so far)", err.Error(), n)
+			}
+			if j.group != nil {
+				logrus.Debugln(`Ignored data:`, j.group)
+			} else {
+				logrus.Debugln(`Ignored data:`, j.split)
+			}
+		}
+
+		// the job was counted as produced, account for it in the
+		// event loop if nothing is produced
+		if msg == nil {
+			if !t.skip(j.trackingID) {
+				return
+			}
+			continue
+		}
+
+		// in test mode, log the message and account for it as if it
+		// had been produced
+		if t.dispatch == nil {
+			data, _ := msg.Value.Encode()
+			logrus.Infof("Test mode, not producing to %s: %s",
+				msg.Topic, string(data))
+			if !t.skip(j.trackingID) {
+				return
+			}
+			continue
+		}
+
+		select {
+		case t.dispatch <- msg:
+		case <-t.halt:
+			return
+		}
+
+		// the shadow copy follows its primary message
+		shadow, err := t.shadowMessage(j)
+		if err != nil {
+			t.shadowFailed(err)
+			continue
+		}
+		if shadow == nil {
+			continue
+		}
+		select {
+		case t.dispatch <- shadow:
+		case <-t.halt:
+			return
+		}
+	}
+}
+
+// encode returns the producer message for j. Metrics that exceed the
+// maximum message size are replaced by a dead letter.
+func (t *Twister) encode(j *job) (*sarama.ProducerMessage, error) {
+	if j.dead != nil {
+		return t.deadLetterMessage(j.dead, j.trackingID)
+	}
+
+	// a group is produced as an array of metrics, all of the same
+	// asset
+	split := &j.split
+	var data []byte
+	var err error
+	if j.group != nil {
+		split = &j.group[0]
+		data, err = marshalSplits(j.group)
+	} else {
+		data, err = json.Marshal(wireSplit{split})
+	}
+	if err != nil {
+		return nil, err
+	}
+	key := strconv.Itoa(int(split.AssetID))
+
+	if size := len(key) + len(data); size > t.maxBytes {
+		return t.deadLetterMessage(&deadLetter{
+			Reason: fmt.Sprintf("Message size %d exceeds limit %d",
+				size, t.maxBytes),
+			AssetID: split.AssetID,
+			Path:    split.Path,
+		}, j.trackingID)
+	}
+
+	return &sarama.ProducerMessage{
+		Topic:    j.topic,
+		Key:      sarama.StringEncoder(key),
+		Value:    sarama.ByteEncoder(data),
+		Metadata: j.trackingID,
+	}, nil
+}
+
+// skip accounts for the job of trackingID in the event loop without
+// producing anything. It returns false if the handler was halted.
+func (t *Twister) skip(trackingID string) bool {
+	select {
+	case t.skipped <- trackingID:
+		return true
+	case <-t.halt:
+		return false
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,112 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/mjolnir42/delay"
+	"github.com/solnx/legacy"
+)
+
+// benchSplits returns the split metrics of batches of n metrics from
+// 16 hosts
+func benchSplits(b *testing.B, n int) [][]legacy.MetricSplit {
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("/sys/bench/metric%d", i)
+	}
+	corpus := make([][]legacy.MetricSplit, 16)
+	for i := range corpus {
+		batch := legacy.MetricBatch{}
+		if err := json.Unmarshal(testBatch(i, paths...),
+			&batch); err != nil {
+			b.Fatal(err)
+		}
+		corpus[i] = batch.Split()
+	}
+	return corpus
+}
+
+// BenchmarkMarshal compares marshalling the split metrics of a batch
+// in the handler workers against marshalling them synchronously
+// before handing them to the producer
+func BenchmarkMarshal(b *testing.B) {
+	corpus := benchSplits(b, 1000)
+
+	// consume reads n messages from dispatch, like the producer
+	consume := func(dispatch chan *sarama.ProducerMessage, n int) chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < n; i++ {
+				<-dispatch
+			}
+			close(done)
+		}()
+		return done
+	}
+
+	b.Run(`synchronous`, func(b *testing.B) {
+		dispatch := make(chan *sarama.ProducerMessage, 256)
+		t := &Twister{Settings: newTestSettings(), dispatch: dispatch}
+		t.maxBytes = maxMessageBytes(t.Settings)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			splits := corpus[i%len(corpus)]
+			done := consume(dispatch, len(splits))
+			for j := range splits {
+				msg, err := t.encode(&job{split: splits[j]})
+				if err != nil {
+					b.Fatal(err)
+				}
+				dispatch <- msg
+			}
+			<-done
+		}
+	})
+
+	b.Run(`workers`, func(b *testing.B) {
+		dispatch := make(chan *sarama.ProducerMessage, 256)
+		t := &Twister{
+			Settings: newTestSettings(),
+			dispatch: dispatch,
+			queues:   make([]*queue, 4),
+			pool:     delay.New(),
+			halt:     make(chan struct{}),
+		}
+		t.maxBytes = maxMessageBytes(t.Settings)
+		for i := range t.queues {
+			t.queues[i] = newQueue()
+			t.pool.Use()
+			go t.worker(t.queues[i])
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			splits := corpus[i%len(corpus)]
+			done := consume(dispatch, len(splits))
+			for j := range splits {
+				t.enqueue(&job{split: splits[j]})
+			}
+			<-done
+		}
+		b.StopTimer()
+
+		t.closeQueues()
+		t.pool.Wait()
+	})
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
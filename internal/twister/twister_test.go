@@ -0,0 +1,412 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/internal/twister"
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Sirupsen/logrus"
+	"github.com/Sirupsen/logrus/hooks/test"
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/twister/internal/config"
+	libtwister "github.com/solnx/twister/lib/twister"
+)
+
+// testTimeout bounds every wait of the tests
+const testTimeout = 5 * time.Second
+
+// testTime is the timestamp of the test batches
+var testTime = time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// logHook records the entries of the standard logger
+var logHook = test.NewGlobal()
+
+// captureLog clears logHook and sets the log level until the returned
+// function is called
+func captureLog(level logrus.Level) func() {
+	previous := logrus.GetLevel()
+	logrus.SetLevel(level)
+	logHook.Reset()
+	return func() {
+		logrus.SetLevel(previous)
+	}
+}
+
+// logged returns the number of recorded entries at level whose
+// message starts with prefix
+func logged(level logrus.Level, prefix string) int {
+	n := 0
+	for _, entry := range logHook.AllEntries() {
+		if entry.Level == level && strings.HasPrefix(entry.Message, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// testHandler is a running handler whose producer is a fakeProducer
+type testHandler struct {
+	*Twister
+	producer *fakeProducer
+	commits  chan *erebos.Commit
+	stopped  chan struct{}
+	offset   int64
+}
+
+// newTestSettings returns settings for a handler without lookup
+func newTestSettings() *config.Config {
+	settings := &config.Config{}
+	settings.Twister.DisableLookup = true
+	return settings
+}
+
+// newTestHandler returns a handler with settings, producing to p. The
+// handler is registered as the only handler, but not yet started.
+func newTestHandler(settings *config.Config, p *fakeProducer) *testHandler {
+	conf := &erebos.Config{}
+	conf.Kafka.ProducerTopic = `twister`
+	registry := metrics.NewRegistry()
+
+	h := &testHandler{
+		Twister: &Twister{
+			Num:      0,
+			Input:    make(chan *erebos.Transport, 16),
+			Shutdown: make(chan struct{}),
+			Ready:    make(chan struct{}),
+			Death:    make(chan error, 4),
+			Config:   conf,
+			Settings: settings,
+			Metrics:  &registry,
+		},
+		producer: p,
+		commits:  make(chan *erebos.Commit, 1024),
+		stopped:  make(chan struct{}),
+	}
+	if p != nil {
+		h.Twister.producer = p
+	}
+	Handlers = map[int]erebos.Handler{0: h.Twister}
+	return h
+}
+
+// start runs the handler until it stopped
+func (h *testHandler) start() {
+	go func() {
+		h.Start()
+		close(h.stopped)
+	}()
+}
+
+// startHandler starts a handler with settings, producing to p. The
+// handler is registered as the only handler.
+func startHandler(t testing.TB, settings *config.Config, p *fakeProducer) *testHandler {
+	h := newTestHandler(settings, p)
+	h.start()
+	select {
+	case <-h.Ready:
+	case err := <-h.Death:
+		t.Fatalf("Handler failed to start: %s", err)
+	case <-time.After(testTimeout):
+		t.Fatal(`Handler did not start`)
+	}
+	return h
+}
+
+// message returns value as the next message of topic partition 0,
+// with a buffered Return channel
+func (h *testHandler) message(value []byte) *erebos.Transport {
+	msg := &erebos.Transport{
+		Value:     value,
+		Topic:     `metrics`,
+		Partition: 0,
+		Offset:    h.offset,
+		Commit:    h.commits,
+		Return:    make(chan error, 1),
+	}
+	h.offset++
+	return msg
+}
+
+// send hands value to the handler as the next message of topic
+// partition 0
+func (h *testHandler) send(value []byte) *erebos.Transport {
+	msg := h.message(value)
+	h.Input <- msg
+	return msg
+}
+
+// waitCommits returns the next n committed offsets
+func (h *testHandler) waitCommits(t testing.TB, n int) []int64 {
+	offsets := make([]int64, 0, n)
+	for len(offsets) < n {
+		select {
+		case c := <-h.commits:
+			offsets = append(offsets, c.Offset)
+		case err := <-h.Death:
+			t.Fatalf("Handler died: %s", err)
+		case <-time.After(testTimeout):
+			t.Fatalf("Received %d of %d commits", len(offsets), n)
+		}
+	}
+	return offsets
+}
+
+// result returns the outcome reported on the Return channel of msg
+func result(t *testing.T, msg *erebos.Transport) error {
+	select {
+	case err := <-msg.Return:
+		return err
+	case <-time.After(testTimeout):
+		t.Fatalf("No result for offset %d", msg.Offset)
+	}
+	return nil
+}
+
+// stop shuts the handler down the way main does and waits until it
+// returned
+func (h *testHandler) stop(t testing.TB) {
+	close(h.Shutdown)
+	close(h.Input)
+	select {
+	case <-h.stopped:
+	case <-time.After(testTimeout):
+		t.Fatal(`Handler did not stop`)
+	}
+}
+
+// testBatch returns a MetricBatch of hostID with one integer metric
+// per path
+func testBatch(hostID int, paths ...string) []byte {
+	return testBatchAt(hostID, testTime, paths...)
+}
+
+// testBatchAt returns a MetricBatch of hostID at ts with one integer
+// metric per path
+func testBatchAt(hostID int, ts time.Time, paths ...string) []byte {
+	metrics := make([]string, 0, len(paths))
+	for i, path := range paths {
+		metrics = append(metrics, fmt.Sprintf(
+			`{"metric":%q,"subtype":"","value":%d}`, path, i))
+	}
+	return []byte(fmt.Sprintf(`{"host_id":%d,"protocol":1,"data":`+
+		`[{"time":%q,"metrics":[%s]}]}`, hostID,
+		ts.Format(time.RFC3339), strings.Join(metrics, `,`)))
+}
+
+func TestHandlerCommitsAfterProduce(t *testing.T) {
+	p := newFakeProducer(nil)
+	h := startHandler(t, newTestSettings(), p)
+
+	h.send(testBatch(7, `/sys/load/60s`, `/sys/load/300s`))
+	h.send(testBatch(7, `/sys/load/900s`))
+	if offsets := h.waitCommits(t, 2); offsets[0] != 0 || offsets[1] != 1 {
+		t.Errorf("Committed offsets %v, expected [0 1]", offsets)
+	}
+
+	produced := p.messages()
+	if len(produced) != 3 {
+		t.Fatalf("Produced %d messages, expected 3", len(produced))
+	}
+	for _, msg := range produced {
+		if msg.Topic != `twister` {
+			t.Errorf("Produced to %s, expected twister", msg.Topic)
+		}
+		if key, _ := msg.Key.Encode(); string(key) != `7` {
+			t.Errorf("Produced with key %s, expected 7", key)
+		}
+		data, _ := msg.Value.Encode()
+		if err := libtwister.ValidateWireFormat(data); err != nil {
+			t.Errorf("Produced invalid metric %s: %s", data, err)
+		}
+	}
+
+	h.stop(t)
+	if !p.isClosed() {
+		t.Error(`Producer was not closed on shutdown`)
+	}
+}
+
+func TestHandlerCommitsOnShutdown(t *testing.T) {
+	p := newFakeProducer(nil)
+	h := startHandler(t, newTestSettings(), p)
+
+	for i := 0; i < 50; i++ {
+		h.send(testBatch(i, `/sys/load/60s`, `/sys/load/300s`))
+	}
+	h.stop(t)
+
+	if n := len(h.commits); n != 50 {
+		t.Errorf("Committed %d offsets during shutdown, expected 50", n)
+	}
+}
+
+func TestHandlerReturnsOutcome(t *testing.T) {
+	h := startHandler(t, newTestSettings(), newFakeProducer(nil))
+
+	valid := h.send(testBatch(1, `/sys/load/60s`))
+	invalid := h.send([]byte(`{"host_id":1,"data":`))
+	if err := result(t, valid); err != nil {
+		t.Errorf("Produced message reported %s", err)
+	}
+	if err := result(t, invalid); err == nil {
+		t.Error(`Invalid message reported no error`)
+	}
+	h.stop(t)
+}
+
+func TestHandlerFailsTrackingOnce(t *testing.T) {
+	restore := captureLog(logrus.WarnLevel)
+	defer restore()
+
+	produceErr := sarama.ErrMessageSizeTooLarge
+	attempted := make(chan struct{}, 2)
+	release := make(chan struct{})
+	p := newFakeProducer(func(*sarama.ProducerMessage) error {
+		attempted <- struct{}{}
+		<-release
+		return produceErr
+	})
+	h := startHandler(t, newTestSettings(), p)
+
+	// both metrics of the batch fail while the handler drains
+	msg := h.send(testBatch(1, `/sys/load/60s`, `/sys/load/300s`))
+	<-attempted
+	close(h.Shutdown)
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	close(h.Input)
+	select {
+	case <-h.stopped:
+	case <-time.After(testTimeout):
+		t.Fatal(`Handler did not stop`)
+	}
+
+	if err := result(t, msg); err != produceErr {
+		t.Errorf("Message reported %v, expected %s", err, produceErr)
+	}
+	if n := logged(logrus.WarnLevel, `Dropped result`); n != 0 {
+		t.Errorf("Reported %d further results", n)
+	}
+	if n := len(h.commits); n != 0 {
+		t.Errorf("Committed %d offsets of a failed message", n)
+	}
+}
+
+func TestUpdateOffsetDuplicateSuccess(t *testing.T) {
+	restore := captureLog(logrus.DebugLevel)
+	defer restore()
+
+	registry := metrics.NewRegistry()
+	h := &Twister{
+		Settings:   newTestSettings(),
+		trackID:    map[string]int{`1`: 1},
+		trackACK:   map[string][]*erebos.Transport{`1`: {{}}},
+		trackTime:  map[string]time.Time{`1`: time.Now()},
+		done:       newCompleted(),
+		commits:    newCommitter(nil),
+		commitTime: metrics.NewRegisteredTimer(`commit`, registry),
+		inflight:   metrics.NewRegisteredGauge(`inflight`, registry),
+	}
+
+	// the second success of trackingID 1 arrives after it completed
+	h.updateOffset(`1`)
+	h.updateOffset(`1`)
+	if n := logged(logrus.WarnLevel, `Unknown trackingID`); n != 0 {
+		t.Errorf("Logged %d warnings for a duplicate success", n)
+	}
+	if n := logged(logrus.DebugLevel, `Late success`); n != 1 {
+		t.Errorf("Logged %d late successes, expected 1", n)
+	}
+
+	// a trackingID that was never tracked is still reported
+	h.updateOffset(`2`)
+	if n := logged(logrus.WarnLevel, `Unknown trackingID`); n != 1 {
+		t.Errorf("Logged %d warnings for an unknown trackingID, "+
+			"expected 1", n)
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	settings := newTestSettings()
+	for configured, expected := range map[int]int{
+		-1: 0, 0: 1024, 16: 16,
+	} {
+		settings.Twister.MaxInFlight = configured
+		if got := maxInFlight(settings); got != expected {
+			t.Errorf("maxInFlight(%d) = %d, expected %d", configured,
+				got, expected)
+		}
+	}
+}
+
+func TestHandlerStopsAtMaxInFlight(t *testing.T) {
+	release := make(chan struct{})
+	p := newFakeProducer(func(*sarama.ProducerMessage) error {
+		<-release
+		return nil
+	})
+	settings := newTestSettings()
+	settings.Twister.MaxInFlight = 2
+	h := startHandler(t, settings, p)
+
+	// no batch is acknowledged, the handler stops reading its input
+	// once two batches are waiting for the producer
+	for i := 0; i < 5; i++ {
+		h.send(testBatch(i, `/sys/load/60s`))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(h.Input); n != 3 {
+		t.Errorf("Handler read %d batches, expected 2", 5-n)
+	}
+	inflight := metrics.GetOrRegisterGauge(`/output/inflight`,
+		*h.Metrics)
+	if n := inflight.Value(); n != 2 {
+		t.Errorf("Reported %d batches in flight, expected 2", n)
+	}
+
+	close(release)
+	h.waitCommits(t, 5)
+	h.stop(t)
+	if n := inflight.Value(); n != 0 {
+		t.Errorf("Reported %d batches in flight after the commits", n)
+	}
+}
+
+// BenchmarkHandlerLargeBatch measures splitting and producing batches
+// of 1000 metrics each
+func BenchmarkHandlerLargeBatch(b *testing.B) {
+	corpus := make([][]byte, 16)
+	for i := range corpus {
+		paths := make([]string, 1000)
+		for j := range paths {
+			paths[j] = fmt.Sprintf("/sys/bench/metric%d", j)
+		}
+		corpus[i] = testBatch(i, paths...)
+	}
+	h := startHandler(b, newTestSettings(), newFakeProducer(nil))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			h.send(corpus[i%len(corpus)])
+		}
+	}()
+	h.waitCommits(b, b.N)
+	b.StopTimer()
+
+	h.stop(b)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,33 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/lib/twister"
+
+import "github.com/solnx/legacy"
+
+// Clone returns a copy of m that shares neither its tags nor its
+// labels with m. The metrics split from one batch share their tags and
+// labels, so a metric that is changed or handed to several consumers
+// must be cloned first.
+func Clone(m legacy.MetricSplit) legacy.MetricSplit {
+	if m.Tags != nil {
+		tags := make([]string, len(m.Tags))
+		copy(tags, m.Tags)
+		m.Tags = tags
+	}
+	if m.Labels != nil {
+		labels := make(map[string]string, len(m.Labels))
+		for k, v := range m.Labels {
+			labels[k] = v
+		}
+		m.Labels = labels
+	}
+	return m
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,52 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/lib/twister"
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/solnx/legacy"
+)
+
+func TestClone(t *testing.T) {
+	// the tags have spare capacity, like the shared tags of a split
+	tags := make([]string, 1, 4)
+	tags[0] = `a`
+	m := legacy.MetricSplit{
+		AssetID: 1,
+		Path:    `/sys/load/60s`,
+		Tags:    tags,
+		Labels:  map[string]string{`proto`: `1`},
+	}
+
+	c := Clone(m)
+	c.Tags[0] = `b`
+	c.Tags = append(c.Tags, `c`)
+	c.Labels[`proto`] = `2`
+	c.Labels[`source`] = `metrics`
+
+	// appending to the clone must not write into the spare capacity
+	if shared := tags[:2]; !reflect.DeepEqual(shared, []string{`a`, ``}) {
+		t.Errorf("Changing the clone changed the tags to %v", shared)
+	}
+	if !reflect.DeepEqual(m.Labels, map[string]string{`proto`: `1`}) {
+		t.Errorf("Changing the clone changed the labels to %v", m.Labels)
+	}
+	if c.AssetID != m.AssetID || c.Path != m.Path {
+		t.Errorf("Clone %d/%s of %d/%s", c.AssetID, c.Path, m.AssetID,
+			m.Path)
+	}
+
+	if c := Clone(legacy.MetricSplit{}); c.Tags != nil || c.Labels != nil {
+		t.Error(`Clone allocated tags or labels that were nil`)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
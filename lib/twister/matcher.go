@@ -0,0 +1,67 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/lib/twister"
+
+import (
+	"path"
+	"strings"
+)
+
+// PathMatcher matches metric paths against a list of patterns. A
+// pattern ending in / matches every path below it, a pattern
+// containing any of *?[ is matched as glob via path.Match, and every
+// other pattern must match the path exactly.
+type PathMatcher struct {
+	exact    map[string]bool
+	prefixes []string
+	globs    []string
+}
+
+// NewPathMatcher compiles patterns into a PathMatcher
+func NewPathMatcher(patterns []string) (*PathMatcher, error) {
+	m := &PathMatcher{
+		exact: make(map[string]bool),
+	}
+	for _, p := range patterns {
+		switch {
+		case strings.ContainsAny(p, `*?[`):
+			// check the pattern syntax once
+			if _, err := path.Match(p, ``); err != nil {
+				return nil, err
+			}
+			m.globs = append(m.globs, p)
+		case strings.HasSuffix(p, `/`):
+			m.prefixes = append(m.prefixes, p)
+		default:
+			m.exact[p] = true
+		}
+	}
+	return m, nil
+}
+
+// Match reports if p matches any pattern. Exact matches are checked
+// first, since they are the cheapest and most common.
+func (m *PathMatcher) Match(p string) bool {
+	if m.exact[p] {
+		return true
+	}
+	for _, prefix := range m.prefixes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	for _, glob := range m.globs {
+		if ok, _ := path.Match(glob, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,69 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/lib/twister"
+
+import "testing"
+
+// testMatch checks that m matches exactly the paths in expected with
+// the value true
+func testMatch(t *testing.T, m *PathMatcher, expected map[string]bool) {
+	for path, match := range expected {
+		if got := m.Match(path); got != match {
+			t.Errorf("Match(%s) = %t, expected %t", path, got, match)
+		}
+	}
+}
+
+func TestPathMatcherExact(t *testing.T) {
+	m, err := NewPathMatcher([]string{`/sys/load/60s`, `/sys/cpu`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMatch(t, m, map[string]bool{
+		`/sys/load/60s`:  true,
+		`/sys/cpu`:       true,
+		`/sys/load/300s`: false,
+		`/sys/load/60`:   false,
+		`/sys/cpu/usage`: false,
+	})
+}
+
+func TestPathMatcherPrefix(t *testing.T) {
+	m, err := NewPathMatcher([]string{`/sys/cpu/`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMatch(t, m, map[string]bool{
+		`/sys/cpu/usage`:       true,
+		`/sys/cpu/core0/usage`: true,
+		`/sys/cpu`:             false,
+		`/sys/cpufreq/core0`:   false,
+	})
+}
+
+func TestPathMatcherGlob(t *testing.T) {
+	m, err := NewPathMatcher([]string{`/sys/disk/*/io`, `/net/eth[01]`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMatch(t, m, map[string]bool{
+		`/sys/disk/sda/io`:     true,
+		`/sys/disk/sdb/io`:     true,
+		`/sys/disk/sda/io/rd`:  false,
+		`/sys/disk/sda/sdb/io`: false,
+		`/net/eth0`:            true,
+		`/net/eth2`:            false,
+	})
+
+	if _, err = NewPathMatcher([]string{`/sys/[`}); err == nil {
+		t.Error(`NewPathMatcher accepted an invalid glob`)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
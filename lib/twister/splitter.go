@@ -0,0 +1,107 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+// Package twister provides the metric batch splitting of the twister
+// application for use in other services, independent of Kafka.
+//
+// A Splitter decodes a legacy.MetricBatch and splits it into
+// individual legacy.MetricSplit metrics. If enrichment is configured,
+// the metrics with a selected path receive the configuration IDs
+// returned by the Enricher as additional tags, the same way the
+// twister application enriches them from eye.
+package twister // import "github.com/solnx/twister/lib/twister"
+
+import (
+	"encoding/json"
+
+	wall "github.com/solnx/eye/lib/eye.wall"
+	"github.com/solnx/legacy"
+)
+
+// Enricher returns the configuration IDs for a metric lookup ID. It is
+// implemented by *wall.Lookup. Metrics without a configuration are
+// reported with wall.ErrUnconfigured.
+type Enricher interface {
+	GetConfigurationID(lookID string) ([]string, error)
+}
+
+// AssetIDFunc derives the AssetID of split from the host ID of the
+// batch it was split from
+type AssetIDFunc func(hostID int64, split *legacy.MetricSplit) int64
+
+// Splitter splits metric batches into individual metrics
+type Splitter struct {
+	enricher Enricher
+	paths    *PathMatcher
+	assetID  AssetIDFunc
+}
+
+// NewSplitter returns a Splitter without enrichment
+func NewSplitter() *Splitter {
+	return &Splitter{}
+}
+
+// Enrich configures s to add the configuration IDs returned by e as
+// tags to all metrics whose path matches paths. The twister
+// application selects the enriched metrics the same way.
+func (s *Splitter) Enrich(e Enricher, paths *PathMatcher) *Splitter {
+	s.enricher = e
+	s.paths = paths
+	return s
+}
+
+// DeriveAssetID configures s to set the AssetID of every metric to the
+// value returned by fn, instead of the host ID of its batch. It is
+// applied before enrichment, so the lookup ID follows the derived
+// AssetID.
+func (s *Splitter) DeriveAssetID(fn AssetIDFunc) *Splitter {
+	s.assetID = fn
+	return s
+}
+
+// Split decodes data as MetricBatch and returns the metrics it
+// contains. Unconfigured metrics are returned without additional
+// tags, any other enrichment error is returned.
+func (s *Splitter) Split(data []byte) ([]legacy.MetricSplit, error) {
+	batch := legacy.MetricBatch{}
+	if err := json.Unmarshal(data, &batch); err != nil {
+		return nil, err
+	}
+	return s.SplitBatch(&batch)
+}
+
+// SplitBatch returns the enriched metrics contained in batch
+func (s *Splitter) SplitBatch(batch *legacy.MetricBatch) ([]legacy.MetricSplit, error) {
+	msgs := batch.Split()
+	if s.assetID != nil {
+		for i := range msgs {
+			msgs[i].AssetID = s.assetID(int64(batch.HostID), &msgs[i])
+		}
+	}
+	if s.enricher == nil {
+		return msgs, nil
+	}
+
+	for i := range msgs {
+		if !s.paths.Match(msgs[i].Path) {
+			continue
+		}
+		tags, err := s.enricher.GetConfigurationID(msgs[i].LookupID())
+		switch err {
+		case nil:
+			msgs[i] = Clone(msgs[i])
+			msgs[i].Tags = append(msgs[i].Tags, tags...)
+		case wall.ErrUnconfigured:
+		default:
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
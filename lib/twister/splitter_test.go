@@ -0,0 +1,177 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/lib/twister"
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	wall "github.com/solnx/eye/lib/eye.wall"
+	"github.com/solnx/legacy"
+)
+
+// testBatch returns a MetricBatch of hostID with one integer metric
+// per path
+func testBatch(hostID int, paths ...string) []byte {
+	metrics := make([]string, 0, len(paths))
+	for i, path := range paths {
+		metrics = append(metrics, fmt.Sprintf(
+			`{"metric":%q,"subtype":"","value":%d}`, path, i))
+	}
+	return []byte(fmt.Sprintf(`{"host_id":%d,"protocol":1,"data":`+
+		`[{"time":"2017-06-01T12:00:00Z","metrics":[%s]}]}`,
+		hostID, strings.Join(metrics, `,`)))
+}
+
+// fakeEnricher returns the configured tags by lookup ID, and
+// wall.ErrUnconfigured for all other metrics
+type fakeEnricher struct {
+	tags    map[string][]string
+	err     error
+	lookups int
+}
+
+// GetConfigurationID implements Enricher
+func (e *fakeEnricher) GetConfigurationID(lookID string) ([]string, error) {
+	e.lookups++
+	if e.err != nil {
+		return nil, e.err
+	}
+	if tags, ok := e.tags[lookID]; ok {
+		return tags, nil
+	}
+	return nil, wall.ErrUnconfigured
+}
+
+// lookupID returns the lookup ID of path for assetID
+func lookupID(assetID int64, path string) string {
+	split := legacy.MetricSplit{AssetID: assetID, Path: path}
+	return split.LookupID()
+}
+
+// paths returns the paths of msgs
+func paths(msgs []legacy.MetricSplit) []string {
+	res := make([]string, 0, len(msgs))
+	for i := range msgs {
+		res = append(res, msgs[i].Path)
+	}
+	return res
+}
+
+func TestSplitterSplitOnly(t *testing.T) {
+	msgs, err := NewSplitter().Split(
+		testBatch(7, `/sys/load/60s`, `/sys/load/300s`))
+	if err != nil {
+		t.Fatalf("Split: %s", err)
+	}
+
+	expected := []string{`/sys/load/60s`, `/sys/load/300s`}
+	if got := paths(msgs); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Split into %v, expected %v", got, expected)
+	}
+	for i := range msgs {
+		if msgs[i].AssetID != 7 || len(msgs[i].Tags) != 0 {
+			t.Errorf("Split %s with AssetID %d and tags %v, expected"+
+				" AssetID 7 without tags", msgs[i].Path,
+				msgs[i].AssetID, msgs[i].Tags)
+		}
+	}
+
+	if _, err = NewSplitter().Split([]byte(`{"host_id":`)); err == nil {
+		t.Error(`Split accepted an invalid batch`)
+	}
+}
+
+func TestSplitterEnrich(t *testing.T) {
+	e := &fakeEnricher{tags: map[string][]string{
+		lookupID(7, `/sys/load/60s`): {`cfg-1`, `cfg-2`},
+	}}
+	paths, err := NewPathMatcher([]string{`/sys/load/60s`,
+		`/sys/load/300s`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSplitter().Enrich(e, paths)
+
+	msgs, err := s.Split(testBatch(7, `/sys/load/60s`, `/sys/load/300s`,
+		`/sys/load/900s`))
+	if err != nil {
+		t.Fatalf("Split: %s", err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("Split into %d metrics, expected 3", len(msgs))
+	}
+
+	// configured, unconfigured and not selected for enrichment
+	if !reflect.DeepEqual(msgs[0].Tags, []string{`cfg-1`, `cfg-2`}) {
+		t.Errorf("Enriched %s with %v, expected [cfg-1 cfg-2]",
+			msgs[0].Path, msgs[0].Tags)
+	}
+	for _, msg := range msgs[1:] {
+		if len(msg.Tags) != 0 {
+			t.Errorf("Enriched %s with %v, expected no tags", msg.Path,
+				msg.Tags)
+		}
+	}
+	if e.lookups != 2 {
+		t.Errorf("Looked up %d metrics, expected 2", e.lookups)
+	}
+
+	// any other lookup error is returned
+	e.err = errors.New(`Redis unavailable`)
+	if _, err = s.Split(testBatch(7, `/sys/load/60s`)); err != e.err {
+		t.Errorf("Split returned %v, expected %s", err, e.err)
+	}
+}
+
+func TestSplitterDeriveAssetID(t *testing.T) {
+	// namespace the host ID by the datacenter in the metric's tag
+	dcs := map[string]int64{`dc1`: 1000, `dc2`: 2000}
+	derive := func(hostID int64, split *legacy.MetricSplit) int64 {
+		if len(split.Tags) == 0 {
+			return hostID
+		}
+		return dcs[split.Tags[0]] + hostID
+	}
+	e := &fakeEnricher{tags: map[string][]string{
+		lookupID(2007, `/sys/load/60s`): {`cfg-1`},
+	}}
+	match, err := NewPathMatcher([]string{`/sys/load/60s`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSplitter().DeriveAssetID(derive).Enrich(e, match)
+
+	msgs, err := s.Split([]byte(`{"host_id":7,"protocol":1,"data":[{` +
+		`"time":"2017-06-01T12:00:00Z","metrics":[` +
+		`{"metric":"/sys/load/60s","subtype":"dc2","value":1},` +
+		`{"metric":"/sys/load/300s","subtype":"dc1","value":2}]}]}`))
+	if err != nil {
+		t.Fatalf("Split: %s", err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("Split into %d metrics, expected 2", len(msgs))
+	}
+	for i, expected := range []int64{2007, 1007} {
+		if msgs[i].AssetID != expected {
+			t.Errorf("Derived AssetID %d for %s, expected %d",
+				msgs[i].AssetID, msgs[i].Path, expected)
+		}
+	}
+	// enrichment looks up the derived AssetID
+	if !reflect.DeepEqual(msgs[0].Tags, []string{`dc2`, `cfg-1`}) {
+		t.Errorf("Enriched %s with %v, expected [dc2 cfg-1]",
+			msgs[0].Path, msgs[0].Tags)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
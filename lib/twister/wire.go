@@ -0,0 +1,136 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/lib/twister"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ValidateWireFormat checks that data is a single metric in the wire
+// format produced by twister. A metric is a JSON array of 8 elements:
+//
+//	0  asset ID       integer
+//	1  metric path    non-empty string
+//	2  timestamp      RFC3339 string, with optional fractional seconds
+//	3  type           integer, long, real, string or tombstone
+//	4  unit           string, may be empty
+//	5  value          integer for integer and long, number for real,
+//	                  string for string, null for tombstone
+//	6  tags           null or array of strings
+//	7  labels         null or object of string values
+//
+// Tombstones are emitted for metrics a host stopped reporting.
+func ValidateWireFormat(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var raw []interface{}
+	if err := dec.Decode(&raw); err != nil {
+		return fmt.Errorf("Not a JSON array: %s", err)
+	}
+	if dec.More() {
+		return fmt.Errorf(`Trailing data after metric`)
+	}
+	if len(raw) != 8 {
+		return fmt.Errorf("Expected 8 elements, got %d", len(raw))
+	}
+
+	if n, ok := raw[0].(json.Number); !ok {
+		return fmt.Errorf(`Asset ID is not a number`)
+	} else if _, err := n.Int64(); err != nil {
+		return fmt.Errorf("Asset ID is not an integer: %s", n)
+	}
+
+	if path, ok := raw[1].(string); !ok || path == `` {
+		return fmt.Errorf(`Metric path is not a non-empty string`)
+	}
+
+	if ts, ok := raw[2].(string); !ok {
+		return fmt.Errorf(`Timestamp is not a string`)
+	} else if _, err := time.Parse(time.RFC3339Nano, ts); err != nil {
+		return fmt.Errorf("Timestamp is not RFC3339: %s", ts)
+	}
+
+	typ, ok := raw[3].(string)
+	if !ok {
+		return fmt.Errorf(`Type is not a string`)
+	}
+
+	if _, ok := raw[4].(string); !ok {
+		return fmt.Errorf(`Unit is not a string`)
+	}
+
+	if err := validateValue(typ, raw[5]); err != nil {
+		return err
+	}
+
+	if raw[6] != nil {
+		tags, ok := raw[6].([]interface{})
+		if !ok {
+			return fmt.Errorf(`Tags are not an array`)
+		}
+		for i := range tags {
+			if _, ok := tags[i].(string); !ok {
+				return fmt.Errorf("Tag %d is not a string", i)
+			}
+		}
+	}
+
+	if raw[7] != nil {
+		labels, ok := raw[7].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf(`Labels are not an object`)
+		}
+		for key, value := range labels {
+			if _, ok := value.(string); !ok {
+				return fmt.Errorf("Label %s is not a string", key)
+			}
+		}
+	}
+	return nil
+}
+
+// validateValue checks that value matches the metric type typ
+func validateValue(typ string, value interface{}) error {
+	switch typ {
+	case `integer`, `long`:
+		n, ok := value.(json.Number)
+		if !ok {
+			return fmt.Errorf("Value of %s metric is not a number", typ)
+		}
+		if _, err := n.Int64(); err != nil {
+			return fmt.Errorf("Value of %s metric is not an integer: %s",
+				typ, n)
+		}
+	case `real`:
+		n, ok := value.(json.Number)
+		if !ok {
+			return fmt.Errorf(`Value of real metric is not a number`)
+		}
+		if _, err := n.Float64(); err != nil {
+			return fmt.Errorf("Value of real metric is invalid: %s", n)
+		}
+	case `string`:
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf(`Value of string metric is not a string`)
+		}
+	case `tombstone`:
+		if value != nil {
+			return fmt.Errorf(`Value of tombstone is not null`)
+		}
+	default:
+		return fmt.Errorf("Unknown metric type: %s", typ)
+	}
+	return nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,58 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package twister // import "github.com/solnx/twister/lib/twister"
+
+import "testing"
+
+func TestValidateWireFormatGood(t *testing.T) {
+	for _, data := range []string{
+		`[7,"/sys/load/60s","2017-06-01T12:00:00Z","integer","",1,null,null]`,
+		`[7,"/sys/load/60s","2017-06-01T12:00:00.5Z","long","",-1,[],{}]`,
+		`[7,"/sys/cpu/usage","2017-06-01T12:00:00+02:00","real","%",0.25,` +
+			`["cpu0"],{"core":"0"}]`,
+		`[7,"/sys/os/name","2017-06-01T12:00:00Z","string","","Linux",` +
+			`null,null]`,
+		`[7,"/sys/load/60s","2017-06-01T12:00:00Z","tombstone","",null,` +
+			`null,null]`,
+	} {
+		if err := ValidateWireFormat([]byte(data)); err != nil {
+			t.Errorf("%s: %s", data, err)
+		}
+	}
+}
+
+func TestValidateWireFormatMalformed(t *testing.T) {
+	for reason, data := range map[string]string{
+		`not an array`:    `{"asset":7}`,
+		`invalid JSON`:    `[7,"/sys/load/60s"`,
+		`trailing data`:   `[7,"/a","2017-06-01T12:00:00Z","integer","",1,null,null][]`,
+		`seven elements`:  `[7,"/a","2017-06-01T12:00:00Z","integer","",1,null]`,
+		`float asset`:     `[7.5,"/a","2017-06-01T12:00:00Z","integer","",1,null,null]`,
+		`string asset`:    `["7","/a","2017-06-01T12:00:00Z","integer","",1,null,null]`,
+		`empty path`:      `[7,"","2017-06-01T12:00:00Z","integer","",1,null,null]`,
+		`epoch timestamp`: `[7,"/a",1496318400,"integer","",1,null,null]`,
+		`bad timestamp`:   `[7,"/a","2017-06-01 12:00:00","integer","",1,null,null]`,
+		`unknown type`:    `[7,"/a","2017-06-01T12:00:00Z","float","",1,null,null]`,
+		`missing unit`:    `[7,"/a","2017-06-01T12:00:00Z","integer",null,1,null,null]`,
+		`float integer`:   `[7,"/a","2017-06-01T12:00:00Z","integer","",1.5,null,null]`,
+		`string real`:     `[7,"/a","2017-06-01T12:00:00Z","real","","0.5",null,null]`,
+		`number string`:   `[7,"/a","2017-06-01T12:00:00Z","string","",1,null,null]`,
+		`tombstone value`: `[7,"/a","2017-06-01T12:00:00Z","tombstone","",0,null,null]`,
+		`tags object`:     `[7,"/a","2017-06-01T12:00:00Z","integer","",1,{},null]`,
+		`numeric tag`:     `[7,"/a","2017-06-01T12:00:00Z","integer","",1,[1],null]`,
+		`labels array`:    `[7,"/a","2017-06-01T12:00:00Z","integer","",1,null,[]]`,
+		`numeric label`:   `[7,"/a","2017-06-01T12:00:00Z","integer","",1,null,{"a":1}]`,
+	} {
+		if err := ValidateWireFormat([]byte(data)); err == nil {
+			t.Errorf("Accepted %s: %s", reason, data)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix